@@ -0,0 +1,129 @@
+package ctxrewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+)
+
+// Problem is a potential issue the rewrite would cause.
+type Problem struct {
+	Pos token.Position
+	Msg string
+}
+
+func (p Problem) String() string {
+	return p.Pos.String() + ": " + p.Msg
+}
+
+// Analyze reports the problems rewriting source with opts would cause,
+// without producing any output. It's meant as a pre-flight check. It fails
+// when the rewrite itself would, as under Strict, just as ProcessWith does.
+func Analyze(source []byte, opts Options) ([]Problem, error) {
+	return analyzeSource("go.go", source, opts)
+}
+
+// AnalyzeFile is like Analyze, but reads the source from filename.
+func AnalyzeFile(filename string, opts Options) ([]Problem, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return analyzeSource(filename, source, opts)
+}
+
+func analyzeSource(filename string, source []byte, opts Options) (
+	[]Problem, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, source, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if opts.OnlyPackage != "" && f.Name.Name != opts.OnlyPackage {
+		return nil, nil
+	}
+	if err := CheckOptions(opts); err != nil {
+		return nil, err
+	}
+	return analyze(fset, f, opts)
+}
+
+func analyze(fset *token.FileSet, f *ast.File, opts Options) (
+	[]Problem, error) {
+	imports := fileImports(f)
+
+	opts.Report = nil
+	r := newRewriter(fset, opts)
+	rewritten := r.rewrite(f).(*ast.File)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// nodes added by the rewrite have no position, which is how the
+	// changes are told apart from the original code below.
+	var problems []Problem
+	add := func(pos token.Pos, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			Pos: fset.Position(pos), Msg: fmt.Sprintf(format, args...)})
+	}
+	ast.Inspect(rewritten, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.CallExpr:
+			added := addedArg(v)
+			if added < 0 {
+				break
+			}
+			if sel, ok := v.Fun.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && imports[x.Name] != "" {
+					add(v.Pos(), "call to external package %s would gain ctx",
+						imports[x.Name])
+					break
+				}
+			}
+			if opts.Ambiguous && !r.local(v.Fun) {
+				original := *v
+				original.Args = append(v.Args[:added:added],
+					v.Args[added+1:]...)
+				add(v.Pos(), "ambiguous call %s would gain ctx",
+					types.ExprString(&original))
+			}
+		}
+		return true
+	})
+	return append(problems, r.inconsistencies(rewritten)...), nil
+}
+
+// addedParam reports whether ft has a parameter added by the rewrite.
+func addedParam(ft *ast.FuncType) bool {
+	for _, field := range ft.Params.List {
+		if len(field.Names) > 0 && field.Names[0].Pos() == token.NoPos {
+			return true
+		}
+	}
+	return false
+}
+
+// addedArg returns the index of the argument the rewrite added to call, or
+// -1 if there isn't one.
+func addedArg(call *ast.CallExpr) int {
+	for i, arg := range call.Args {
+		if arg.Pos() == token.NoPos {
+			return i
+		}
+	}
+	return -1
+}
+
+// importedName guesses the package name for an import path: its last
+// element.
+func importedName(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '/' {
+			return path[i+1:]
+		}
+	}
+	return path
+}
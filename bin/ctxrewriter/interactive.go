@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jtolds/ctxrewriter"
+)
+
+// prompter asks the user a question and returns their answer, so that the
+// interactive mode can be driven by something other than a terminal.
+type prompter interface {
+	Prompt(question string) (answer string, err error)
+}
+
+// linePrompter prompts on out and reads answers a line at a time from in.
+type linePrompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p linePrompter) Prompt(question string) (string, error) {
+	fmt.Fprint(p.out, question)
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// interactive shows the diff for each of filenames that rewriting would
+// change and asks whether to apply it: y applies it, n skips it, a applies it
+// and all the rest without asking, and q stops. Files that can't be
+// processed or written are reported with fileFailed and skipped; only
+// failing to prompt stops early.
+func interactive(filenames []string, opts ctxrewriter.Options,
+	p prompter) error {
+	all := false
+	for _, filename := range filenames {
+		original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+		if err != nil {
+			fileFailed(filename, err)
+			continue
+		}
+		if bytes.Equal(original, processed) {
+			continue
+		}
+		if !all {
+			_, err = os.Stdout.Write(
+				ctxrewriter.UnifiedDiff(filename, original, processed))
+			if err != nil {
+				return err
+			}
+		}
+		for !all {
+			answer, err := p.Prompt(
+				fmt.Sprintf("apply changes to %s [y,n,a,q]? ", filename))
+			if err != nil {
+				return err
+			}
+			switch answer {
+			case "y":
+			case "n":
+				processed = nil
+			case "a":
+				all = true
+			case "q":
+				return nil
+			default:
+				continue
+			}
+			break
+		}
+		if processed == nil {
+			continue
+		}
+		err = ioutil.WriteFile(filename, processed, 0644)
+		if err != nil {
+			fileFailed(filename, err)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/jtolds/ctxrewriter"
 )
@@ -10,15 +20,704 @@ import (
 var (
 	inplaceFlag = flag.Bool("w", false,
 		"if true, write to source file instead of stdout")
+	recursiveFlag = flag.Bool("r", false,
+		"if true, process the .go files in directories given as arguments, "+
+			"recursively, skipping vendor, testdata and dot directories")
+	interactiveFlag = flag.Bool("i", false,
+		"if true, show each file's changes and ask whether to apply them")
+	analyzeFlag = flag.Bool("analyze", false,
+		"if true, only report problems the rewrite would cause")
+	ambiguousFlag = flag.Bool("ambiguous", false,
+		"if true, analyze, also listing calls that would gain ctx but "+
+			"can't be classified as local")
+	listFlag = flag.Bool("l", false,
+		"if true, only list the files whose contents would change, one "+
+			"per line, exiting non-zero if there are any")
+	diffFlag = flag.Bool("diff", false,
+		"if true, print a unified diff of each file's changes instead of "+
+			"the rewritten file")
+	htmlFlag = flag.Bool("html", false,
+		"if true, print an HTML diff of each file's changes instead of "+
+			"the rewritten file")
+	backgroundGoroutinesFlag = flag.Bool("background-goroutines", false,
+		"if true, launch goroutine closures with context.Background()")
+	stdlibFlag = flag.Bool("stdlib", false,
+		"if true, migrate golang.org/x/net/context imports to the "+
+			"standard library context package")
+	importFlag = flag.String("import", "",
+		"if set, the import path of the context package to use instead "+
+			"of context, e.g. golang.org/x/net/context")
+	stampFlag = flag.Bool("stamp", false,
+		"if true, record the ctxrewriter version in a comment")
+	keepImportsFlag = flag.Bool("keep-unused-imports", false,
+		"if true, don't remove context imports left unused by the rewrite")
+	skipFuncValuesFlag = flag.Bool("skip-func-values", false,
+		"if true, don't change functions that are also used as values")
+	boundaryThreadFlag = flag.Bool("boundary-thread", false,
+		"if true, only change exported functions and the unexported "+
+			"ones they call")
+	preCommitFlag = flag.Bool("pre-commit", false,
+		"if true, rewrite and re-stage the staged .go files, exiting "+
+			"non-zero if any changed, for use as a git pre-commit hook")
+	multiFlag = flag.Bool("multi", false,
+		"if true, read files from stdin, each introduced by a "+
+			"'//FILE: name.go' line, and write them to stdout the same way")
+	warnUnusedFlag = flag.Bool("warn-unused", false,
+		"if true, warn about functions that don't use their new ctx")
+	silenceUnusedFlag = flag.Bool("silence-unused", false,
+		"if true, add '_ = ctx' to functions that don't use their new ctx")
+	leafFuncsFlag = flag.String("leaf-funcs", "",
+		"if set, a comma-separated list of functions that shouldn't take ctx")
+	onlyPackageFlag = flag.String("only-package", "",
+		"if set, only rewrite files in the package with this name")
+	tagsFlag = flag.String("tags", "",
+		"if set, a comma-separated list of build tags; only files whose "+
+			"build constraints they satisfy are rewritten")
+	strictFlag = flag.Bool("strict", false,
+		"if true, fail on calls that can't be classified as local")
+	indentSpacesFlag = flag.Int("indent-spaces", 0,
+		"if positive, indent with this many spaces instead of tabs")
+	maxLineWidthFlag = flag.Int("max-line-width", 0,
+		"if positive, wrap argument and parameter lists on lines longer "+
+			"than this many columns")
+	allowPackagesFlag = flag.String("allow-packages", "",
+		"if set, a comma-separated list of the only import paths whose "+
+			"functions' calls gain ctx; a trailing /... matches subpackages")
+	denyPackagesFlag = flag.String("deny-packages", "",
+		"if set, a comma-separated list of import paths whose functions' "+
+			"calls don't gain ctx; a trailing /... matches subpackages")
+	fallbackFlag = flag.String("fallback", "",
+		"if set, Background or TODO: the context function passed where no "+
+			"ctx is in scope (default Background)")
+	onlyPackageCallsFlag = flag.Bool("only-package-calls", false,
+		"if true, only calls to the package's own functions and methods "+
+			"gain ctx")
+	exemptMethodsFlag = flag.String("exempt-methods", "",
+		"if set, a semicolon-separated list of method signatures, like "+
+			"String() string, to leave alone instead of the default ones")
+	onlyCallsToFlag = flag.String("only-calls-to", "",
+		"if set, a comma-separated list of the only functions whose calls "+
+			"gain ctx")
+	moduleFlag = flag.String("module", "",
+		"if set, the module path; calls into other modules' packages "+
+			"don't gain ctx. 'auto' reads it from go.mod")
+	validateFlag = flag.Bool("validate", false,
+		"if true, warn about calls that disagree with rewritten definitions")
+	skipTypeDeclsFlag = flag.Bool("skip-type-decls", false,
+		"if true, only add ctx to function signatures, not to func types "+
+			"used as types")
+	documentFlag = flag.Bool("document", false,
+		"if true, document the new ctx parameter in doc comments")
+	limitFlag = flag.Int("limit", 0,
+		"if positive, only rewrite the first this many files, by path, "+
+			"that need changes")
+	typeCheckFlag = flag.Bool("type-check", false,
+		"if true, use type information to leave conversions to named "+
+			"types alone")
+	contextTypeCheckFlag = flag.Bool("context-type-check", false,
+		"if true, first check that the context package to import exports "+
+			"a Context type")
+	reportFlag = flag.String("report", "",
+		"if set, write a JSON report of the rewrite to this file")
+	metricsFlag = flag.String("metrics", "",
+		"if set, write counts of what the rewrite did to this file, in "+
+			"Prometheus text format")
+	mappingFlag = flag.String("mapping", "",
+		"if set, write a JSON file mapping each function whose signature "+
+			"changed to its old and new signatures")
+	codemodFlag = flag.String("codemod", "",
+		"if set, write a JSON file describing the exported signatures that "+
+			"changed, for codemod tools updating non-Go callers")
+	targetLinesFlag = flag.String("target-lines", "",
+		"if set, a comma-separated list of file:line positions; only the "+
+			"functions declared there are rewritten")
+	varFlag = flag.String("var", "",
+		"if set, the name to give ctx parameters instead of ctx")
+	paramIndexFlag = flag.Int("param-index", 0,
+		"the position among parameters and arguments at which to add ctx, "+
+			"e.g. 1 to add it after a leading *sql.Tx")
+	varByPackageFlag = flag.String("var-by-package", "",
+		"if set, a comma-separated list of package=name pairs giving the "+
+			"ctx variable name to use in each package")
+	buildErrorsFlag = flag.String("build-errors", "",
+		"if set, a file of go build output; only the calls it reports as "+
+			"having the wrong number of arguments are fixed")
 )
 
+// The exit statuses: exitFailed is for errors processing files, and for -l
+// and -diff finding files that would change, and exitUsage is for bad flags.
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+// differed is set when -diff or -l finds a file that rewriting would change,
+// to exit with a non-zero status so that CI can check the rewrite has been
+// applied.
+var differed bool
+
+// failed is set when a file couldn't be processed. The remaining files are
+// still processed, but the exit status is non-zero.
+var failed bool
+
+// filesProcessed and fileErrors count the files that were and weren't
+// processed successfully, for -metrics.
+var filesProcessed, fileErrors int
+
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command, returning its exit status.
+func run() int {
+	if err := flagsFromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
 	flag.Parse()
-	for _, filename := range flag.Args() {
-		err := ctxrewriter.ProcessFile(filename, *inplaceFlag)
+	if *ambiguousFlag {
+		*analyzeFlag = true
+	}
+	opts := ctxrewriter.Options{
+		BackgroundGoroutines: *backgroundGoroutinesFlag,
+		StdlibContext:        *stdlibFlag,
+		StampVersion:         *stampFlag,
+		KeepUnusedImports:    *keepImportsFlag,
+		SkipFuncValues:       *skipFuncValuesFlag,
+		BoundaryThread:       *boundaryThreadFlag,
+		WarnUnusedCtx:        *warnUnusedFlag,
+		SilenceUnused:        *silenceUnusedFlag,
+		OnlyPackage:          *onlyPackageFlag,
+		Strict:               *strictFlag,
+		IndentSpaces:         *indentSpacesFlag,
+		MaxLineWidth:         *maxLineWidthFlag,
+		Fallback:             *fallbackFlag,
+		OnlyPackageCalls:     *onlyPackageCallsFlag,
+		Validate:             *validateFlag,
+		SkipTypeDecls:        *skipTypeDeclsFlag,
+		DocumentCtx:          *documentFlag,
+		TypeCheck:            *typeCheckFlag,
+		Ambiguous:            *ambiguousFlag,
+		VarName:              *varFlag,
+		ImportPath:           *importFlag,
+		ParamIndex:           *paramIndexFlag,
+		Report:               &ctxrewriter.Report{}}
+	if *targetLinesFlag != "" {
+		targets, err := parseTargetLines(*targetLinesFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitUsage
+		}
+		opts.TargetLines = targets
+	}
+	if *leafFuncsFlag != "" {
+		opts.LeafFuncs = strings.Split(*leafFuncsFlag, ",")
+	}
+	if *tagsFlag != "" {
+		opts.Tags = strings.Split(*tagsFlag, ",")
+	}
+	if *allowPackagesFlag != "" {
+		opts.AllowPackages = strings.Split(*allowPackagesFlag, ",")
+	}
+	if *denyPackagesFlag != "" {
+		opts.DenyPackages = strings.Split(*denyPackagesFlag, ",")
+	}
+	if *exemptMethodsFlag != "" {
+		opts.ExemptMethods = strings.Split(*exemptMethodsFlag, ";")
+	}
+	if *onlyCallsToFlag != "" {
+		opts.OnlyCallsTo = strings.Split(*onlyCallsToFlag, ",")
+	}
+	if *moduleFlag == "auto" {
+		module, err := ctxrewriter.ModulePath(".")
 		if err != nil {
-			fmt.Println(err.Error())
-			break
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+		opts.ModulePath = module
+	} else {
+		opts.ModulePath = *moduleFlag
+	}
+	if *varByPackageFlag != "" {
+		names, err := parseVarByPackage(*varByPackageFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitUsage
+		}
+		opts.VarNameByPackage = names
+	}
+	opts, err := ctxrewriter.OptionsFromEnv(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	if err := ctxrewriter.CheckOptions(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	if *contextTypeCheckFlag {
+		if err := ctxrewriter.CheckContextType(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+	}
+	if *buildErrorsFlag != "" {
+		output, err := ioutil.ReadFile(*buildErrorsFlag)
+		if err == nil {
+			err = ctxrewriter.ProcessErrors(
+				ctxrewriter.ParseBuildErrors(output), *inplaceFlag, opts)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+		return exitOK
+	}
+	if *preCommitFlag {
+		changed, err := preCommit(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+		if changed {
+			fmt.Fprintln(os.Stderr,
+				"rewrote and re-staged files; please commit again")
+			return exitFailed
+		}
+		return exitStatus()
+	}
+	if *multiFlag {
+		err := processMulti(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+		return exitOK
+	}
+	filenames := flag.Args()
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+	if *recursiveFlag {
+		var err error
+		filenames, err = expandDirs(filenames)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailed
+		}
+	}
+	if *diffFlag && *inplaceFlag {
+		fmt.Fprintln(os.Stderr, "cannot use -diff with -w")
+		return exitUsage
+	}
+	for _, filename := range filenames {
+		if filename == "-" && *inplaceFlag {
+			fmt.Fprintln(os.Stderr, "cannot use -w when reading from stdin")
+			return exitUsage
+		}
+		if filename == "-" && *interactiveFlag {
+			fmt.Fprintln(os.Stderr, "cannot use -i when reading from stdin")
+			return exitUsage
+		}
+	}
+	if *interactiveFlag {
+		err := interactive(filenames, opts,
+			linePrompter{in: bufio.NewReader(os.Stdin), out: os.Stdout})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = true
+		}
+		finish(opts)
+		return exitStatus()
+	}
+	if *limitFlag > 0 && !*analyzeFlag && !*listFlag && !*htmlFlag &&
+		!*diffFlag {
+		processLimited(filenames, *limitFlag, opts)
+		finish(opts)
+		return exitStatus()
+	}
+	for _, filename := range filenames {
+		var err error
+		if filename == "-" {
+			err = processStdin(opts)
+		} else if *analyzeFlag {
+			err = analyze(filename, opts)
+		} else if *listFlag {
+			err = list(filename, opts)
+		} else if *htmlFlag {
+			err = htmlDiff(filename, opts)
+		} else if *diffFlag {
+			err = diff(filename, opts)
+		} else if *recursiveFlag && *inplaceFlag {
+			err = rewriteChanged(filename, opts)
+		} else {
+			err = ctxrewriter.ProcessFileWith(filename, *inplaceFlag, opts)
+		}
+		if err != nil {
+			fileFailed(filename, err)
+		} else {
+			filesProcessed++
+		}
+	}
+	finish(opts)
+	return exitStatus()
+}
+
+// fileFailed reports that filename couldn't be processed because of err, so
+// that the run can go on with the remaining files and fail at the end.
+func fileFailed(filename string, err error) {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, filename+":") {
+		msg = filename + ": " + msg
+	}
+	fmt.Fprintln(os.Stderr, msg)
+	failed = true
+	fileErrors++
+}
+
+// finish prints the warnings gathered in opts.Report and writes it out if
+// asked to.
+func finish(opts ctxrewriter.Options) {
+	for _, warning := range opts.Report.Warnings {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+	if *reportFlag != "" {
+		err := writeJSON(*reportFlag, opts.Report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = true
+		}
+	}
+	if *metricsFlag != "" {
+		err := writeMetrics(*metricsFlag, opts.Report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = true
+		}
+	}
+	if *mappingFlag != "" {
+		err := writeJSON(*mappingFlag, opts.Report.Signatures)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = true
+		}
+	}
+	if *codemodFlag != "" {
+		err := writeJSON(*codemodFlag, opts.Report.Codemod())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = true
+		}
+	}
+}
+
+// exitStatus returns the exit status for a run that got past flag handling.
+func exitStatus() int {
+	if differed || failed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// processLimited rewrites only the first limit files, in path order, whose
+// contents would change, and reports how many were rewritten and how many
+// still need rewriting. Files that can't be processed are reported with
+// fileFailed and skipped.
+func processLimited(filenames []string, limit int,
+	opts ctxrewriter.Options) {
+	filenames = append([]string(nil), filenames...)
+	sort.Strings(filenames)
+	changed, remaining := 0, 0
+	for _, filename := range filenames {
+		if changed >= limit {
+			// only counting these, so keep them out of the report
+			opts.Report = nil
+		}
+		original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+		if err != nil {
+			fileFailed(filename, err)
+			continue
+		}
+		if bytes.Equal(original, processed) {
+			filesProcessed++
+			continue
+		}
+		if changed >= limit {
+			filesProcessed++
+			remaining++
+			continue
+		}
+		if *inplaceFlag {
+			err = ioutil.WriteFile(filename, processed, 0644)
+		} else {
+			_, err = os.Stdout.Write(processed)
+		}
+		if err != nil {
+			fileFailed(filename, err)
+			continue
+		}
+		filesProcessed++
+		changed++
+	}
+	fmt.Fprintf(os.Stderr, "rewrote %d files, %d remaining\n",
+		changed, remaining)
+}
+
+func writeJSON(filename string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// writeMetrics writes counters summarizing the run to filename in the
+// Prometheus text exposition format.
+func writeMetrics(filename string, report *ctxrewriter.Report) error {
+	funcs, calls := 0, 0
+	for _, fn := range report.Funcs {
+		if fn.Rewritten {
+			funcs++
+		}
+		calls += fn.Calls
+	}
+	var out bytes.Buffer
+	for _, metric := range []struct {
+		name, help string
+		value      int
+	}{
+		{"files_processed", "Files processed.", filesProcessed},
+		{"funcs_modified", "Functions that gained a ctx parameter.", funcs},
+		{"calls_modified", "Calls within functions that gained a ctx " +
+			"argument.", calls},
+		{"files_skipped", "Files left unchanged.", len(report.Unchanged)},
+		{"errors", "Files that couldn't be processed.", fileErrors},
+	} {
+		name := "ctxrewriter_" + metric.name
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+			name, metric.help, name, name, metric.value)
+	}
+	return ioutil.WriteFile(filename, out.Bytes(), 0644)
+}
+
+// commandFlags are the flags that don't simply set an Options field, which
+// ctxrewriter.OptionsFromEnv reads from the environment instead.
+var commandFlags = map[string]bool{
+	"w": true, "r": true, "i": true, "l": true, "analyze": true,
+	"ambiguous": true, "diff": true, "html": true, "pre-commit": true,
+	"multi": true, "limit": true, "module": true, "context-type-check": true,
+	"report": true, "metrics": true, "mapping": true, "codemod": true,
+	"target-lines": true, "var-by-package": true, "build-errors": true,
+}
+
+// flagsFromEnv sets each of commandFlags from its environment variable, if
+// set: -w from CTXREWRITER_W, -build-errors from CTXREWRITER_BUILD_ERRORS,
+// and so on. It runs before flag.Parse, so the command line takes
+// precedence.
+func flagsFromEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "CTXREWRITER_" +
+			strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !commandFlags[f.Name] || !ok || err != nil {
+			return
+		}
+		if set_err := flag.Set(f.Name, value); set_err != nil {
+			err = fmt.Errorf("%s: %v", name, set_err)
+		}
+	})
+	return err
+}
+
+// expandDirs replaces each directory in filenames with the .go files found
+// under it, skipping vendor, testdata and dot directories.
+func expandDirs(filenames []string) ([]string, error) {
+	var expanded []string
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if filename == "-" || (err == nil && !info.IsDir()) {
+			expanded = append(expanded, filename)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.WalkDir(filename, func(path string, d fs.DirEntry,
+			err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				name := d.Name()
+				if path != filename && (name == "vendor" ||
+					name == "testdata" || strings.HasPrefix(name, ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, ".go") {
+				expanded = append(expanded, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// rewriteChanged rewrites filename in place, and prints its name, only if
+// rewriting changes it.
+func rewriteChanged(filename string, opts ctxrewriter.Options) error {
+	original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+	if err != nil || bytes.Equal(original, processed) {
+		return err
+	}
+	err = ioutil.WriteFile(filename, processed, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Println(filename)
+	return nil
+}
+
+// processStdin rewrites stdin to stdout, or analyzes or lists it as
+// requested.
+func processStdin(opts ctxrewriter.Options) error {
+	source, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	if *analyzeFlag {
+		problems, err := ctxrewriter.Analyze(source, opts)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		return nil
+	}
+	processed, err := ctxrewriter.ProcessWith(source, opts)
+	if err != nil {
+		return err
+	}
+	if *listFlag {
+		if !bytes.Equal(source, processed) {
+			differed = true
+			fmt.Println("<standard input>")
+		}
+		return nil
+	}
+	if *htmlFlag {
+		processed, err = ctxrewriter.HTMLDiff("<standard input>", source,
+			processed)
+		if err != nil {
+			return err
+		}
+	} else if *diffFlag {
+		processed = ctxrewriter.UnifiedDiff("<standard input>", source,
+			processed)
+		differed = differed || processed != nil
+	}
+	_, err = os.Stdout.Write(processed)
+	return err
+}
+
+func processMulti(opts ctxrewriter.Options) error {
+	source, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	processed, err := ctxrewriter.ProcessMulti(source, opts)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(processed)
+	return err
+}
+
+func analyze(filename string, opts ctxrewriter.Options) error {
+	problems, err := ctxrewriter.AnalyzeFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	return nil
+}
+
+// list prints filename, and nothing else, if rewriting would change it, so
+// that the output can be piped to xargs.
+func list(filename string, opts ctxrewriter.Options) error {
+	original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(original, processed) {
+		differed = true
+		fmt.Println(filename)
+	}
+	return nil
+}
+
+func diff(filename string, opts ctxrewriter.Options) error {
+	original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+	if err != nil {
+		return err
+	}
+	diff := ctxrewriter.UnifiedDiff(filename, original, processed)
+	if diff == nil {
+		return nil
+	}
+	differed = true
+	_, err = os.Stdout.Write(diff)
+	return err
+}
+
+func htmlDiff(filename string, opts ctxrewriter.Options) error {
+	original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+	if err != nil {
+		return err
+	}
+	diff, err := ctxrewriter.HTMLDiff(filename, original, processed)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(diff)
+	return err
+}
+
+// parseTargetLines parses a comma-separated list of file:line positions.
+func parseTargetLines(value string) (map[string][]int, error) {
+	targets := map[string][]int{}
+	for _, target := range strings.Split(value, ",") {
+		i := strings.LastIndex(target, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid target %q, want file:line", target)
+		}
+		line, err := strconv.Atoi(target[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q, want file:line", target)
+		}
+		targets[target[:i]] = append(targets[target[:i]], line)
+	}
+	return targets, nil
+}
+
+// parseVarByPackage parses a comma-separated list of package=name pairs.
+func parseVarByPackage(value string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid pair %q, want package=name", pair)
 		}
+		names[pair[:i]] = pair[i+1:]
 	}
+	return names, nil
 }
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jtolds/ctxrewriter"
+)
+
+const (
+	badSource   = "package p\n\nfunc {\n"
+	plainSource = "package p\n\nfunc work() {}\n\nfunc run() { work() }\n"
+	ctxSource   = "package p\n\nimport \"context\"\n\n" +
+		"func work(ctx context.Context) {}\n\n" +
+		"func run(ctx context.Context) { work(ctx) }\n"
+)
+
+// writeFiles writes the named files' contents to a new temporary
+// directory, returning its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(filename), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filename, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readFile(t *testing.T, filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// resetStatus clears the run's status, restoring it after the test.
+func resetStatus(t *testing.T) {
+	savedDiffered, savedFailed := differed, failed
+	savedProcessed, savedErrors := filesProcessed, fileErrors
+	t.Cleanup(func() {
+		differed, failed = savedDiffered, savedFailed
+		filesProcessed, fileErrors = savedProcessed, savedErrors
+	})
+	differed, failed = false, false
+	filesProcessed, fileErrors = 0, 0
+}
+
+// runCLI runs the command with args and stdin as its standard input,
+// returning its exit status and what it wrote to standard output and error.
+// The flags and the run's status are reset first.
+func runCLI(t *testing.T, stdin string, args ...string) (status int,
+	stdout, stderr string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "test.") {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	resetStatus(t)
+	savedArgs := os.Args
+	savedIn, savedOut, savedErr := os.Stdin, os.Stdout, os.Stderr
+	defer func() {
+		os.Args = savedArgs
+		os.Stdin, os.Stdout, os.Stderr = savedIn, savedOut, savedErr
+	}()
+	dir := t.TempDir()
+	open := func(name string) *os.File {
+		fh, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fh
+	}
+	in, out, errOut := open("stdin"), open("stdout"), open("stderr")
+	defer in.Close()
+	defer out.Close()
+	defer errOut.Close()
+	if _, err := in.WriteString(stdin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	os.Args = append([]string{"ctxrewriter"}, args...)
+	os.Stdin, os.Stdout, os.Stderr = in, out, errOut
+	status = run()
+	stdout = readFile(t, out.Name())
+	stderr = readFile(t, errOut.Name())
+	return status, stdout, stderr
+}
+
+func TestList(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": plainSource, "b.go": ctxSource, "c.go": plainSource})
+	a, b, c := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go"),
+		filepath.Join(dir, "c.go")
+	status, stdout, _ := runCLI(t, "", "-l", a, b, c)
+	if status != exitFailed {
+		t.Errorf("got status %d, want %d", status, exitFailed)
+	}
+	if want := a + "\n" + c + "\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+
+	status, stdout, _ = runCLI(t, "", "-l", b)
+	if status != exitOK || stdout != "" {
+		t.Errorf("got status %d and %q for an unchanged file", status,
+			stdout)
+	}
+}
+
+func TestListTree(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"done.go": ctxSource, "sub/todo.go": plainSource})
+	status, stdout, _ := runCLI(t, "", "-l", "-r", dir)
+	if status != exitFailed {
+		t.Errorf("got status %d, want %d", status, exitFailed)
+	}
+	if want := filepath.Join(dir, "sub/todo.go") + "\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub/todo.go"),
+		[]byte(ctxSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	status, stdout, _ = runCLI(t, "", "-l", "-r", dir)
+	if status != exitOK || stdout != "" {
+		t.Errorf("got status %d and %q for a rewritten tree", status,
+			stdout)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	for _, args := range [][]string{nil, {"-"}} {
+		status, stdout, _ := runCLI(t, plainSource, args...)
+		if status != exitOK {
+			t.Errorf("%q: got status %d, want %d", args, status, exitOK)
+		}
+		if stdout != ctxSource {
+			t.Errorf("%q: got:\n%s\nwant:\n%s", args, stdout, ctxSource)
+		}
+	}
+
+	status, stdout, stderr := runCLI(t, plainSource, "-w")
+	if status != exitUsage || stdout != "" ||
+		stderr != "cannot use -w when reading from stdin\n" {
+		t.Errorf("-w: got status %d, stdout %q and stderr %q", status,
+			stdout, stderr)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.go": plainSource})
+	a := filepath.Join(dir, "a.go")
+	status, stdout, _ := runCLI(t, "", "-diff", a)
+	if status != exitFailed {
+		t.Errorf("got status %d, want %d", status, exitFailed)
+	}
+	want := "--- " + a + "\n+++ " + a + "\n" +
+		"@@ -1,5 +1,7 @@\n" +
+		" package p\n" +
+		" \n" +
+		"-func work() {}\n" +
+		"+import \"context\"\n" +
+		" \n" +
+		"-func run() { work() }\n" +
+		"+func work(ctx context.Context) {}\n" +
+		"+\n" +
+		"+func run(ctx context.Context) { work(ctx) }\n"
+	if stdout != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stdout, want)
+	}
+	if got := readFile(t, a); got != plainSource {
+		t.Errorf("-diff changed the file:\n%s", got)
+	}
+
+	status, _, stderr := runCLI(t, "", "-diff", "-w", a)
+	if status != exitUsage || stderr != "cannot use -diff with -w\n" {
+		t.Errorf("-diff -w: got status %d and %q", status, stderr)
+	}
+}
+
+func TestImportFlags(t *testing.T) {
+	netSource := strings.Replace(ctxSource, `"context"`,
+		`"golang.org/x/net/context"`, 1)
+	for _, test := range []struct {
+		args []string
+		in   string
+		want string
+	}{
+		{nil, plainSource, ctxSource},
+		{[]string{"-import", "context"}, plainSource, ctxSource},
+		{[]string{"-import", "golang.org/x/net/context"}, plainSource,
+			netSource},
+		// an existing x/net/context import is reused unless migrated
+		{nil, netSource, netSource},
+		{[]string{"-stdlib"}, netSource, ctxSource},
+	} {
+		_, stdout, _ := runCLI(t, test.in, test.args...)
+		if stdout != test.want {
+			t.Errorf("%q: got:\n%s\nwant:\n%s", test.args, stdout,
+				test.want)
+		}
+	}
+}
+
+func TestInteractiveStdin(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": plainSource, "b.go": plainSource})
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	status, stdout, _ := runCLI(t, "n\ny\n", "-i", a, b)
+	if status != exitOK {
+		t.Errorf("got status %d, want %d", status, exitOK)
+	}
+	if got := readFile(t, a); got != plainSource {
+		t.Errorf("a.go was rewritten after answering n:\n%s", got)
+	}
+	if got := readFile(t, b); got != ctxSource {
+		t.Errorf("b.go wasn't rewritten after answering y:\n%s", got)
+	}
+	if !strings.Contains(stdout, "--- "+a+"\n") ||
+		!strings.Contains(stdout, "--- "+b+"\n") {
+		t.Errorf("diffs weren't shown:\n%s", stdout)
+	}
+}
+
+func TestMulti(t *testing.T) {
+	stdin := "//FILE: a.go\n" + plainSource + "//FILE: b.go\n" + ctxSource
+	status, stdout, _ := runCLI(t, stdin, "-multi")
+	if status != exitOK {
+		t.Errorf("got status %d, want %d", status, exitOK)
+	}
+	if want := "//FILE: a.go\n" + ctxSource + "//FILE: b.go\n" +
+		ctxSource; stdout != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stdout, want)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go":               plainSource,
+		"done.go":            ctxSource,
+		"sub/b.go":           plainSource,
+		"sub/deeper/c.go":    plainSource,
+		"vendor/v/v.go":      plainSource,
+		"testdata/t.go":      plainSource,
+		".hidden/h.go":       plainSource,
+		"sub/notes.txt":      plainSource,
+		"sub/deeper/.x/d.go": plainSource,
+	})
+	status, stdout, _ := runCLI(t, "", "-r", "-w", dir)
+	if status != exitOK {
+		t.Errorf("got status %d, want %d", status, exitOK)
+	}
+	rewritten := []string{"a.go", "sub/b.go", "sub/deeper/c.go"}
+	var want string
+	for _, name := range rewritten {
+		want += filepath.Join(dir, name) + "\n"
+		if got := readFile(t, filepath.Join(dir, name)); got != ctxSource {
+			t.Errorf("%s wasn't rewritten:\n%s", name, got)
+		}
+	}
+	if stdout != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stdout, want)
+	}
+	for _, name := range []string{"vendor/v/v.go", "testdata/t.go",
+		".hidden/h.go", "sub/notes.txt", "sub/deeper/.x/d.go"} {
+		if got := readFile(t, filepath.Join(dir, name)); got != plainSource {
+			t.Errorf("%s was rewritten:\n%s", name, got)
+		}
+	}
+}
+
+func TestContinueAfterError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": badSource, "b.go": plainSource})
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	status, _, stderr := runCLI(t, "", "-w", a, b)
+	if status != exitFailed {
+		t.Errorf("got status %d, want %d", status, exitFailed)
+	}
+	if !strings.HasPrefix(stderr, a+":") {
+		t.Errorf("error isn't prefixed with the filename: %q", stderr)
+	}
+	if got := readFile(t, b); got != ctxSource {
+		t.Errorf("b.go wasn't rewritten after a.go failed:\n%s", got)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"plain.go": plainSource, "done.go": ctxSource, "bad.go": badSource})
+	for _, test := range []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"done.go"}, exitOK},
+		{[]string{"-l", "done.go"}, exitOK},
+		{[]string{"-l", "plain.go"}, exitFailed},
+		{[]string{"bad.go"}, exitFailed},
+		{[]string{"-fallback", "Bogus", "done.go"}, exitUsage},
+		{[]string{"-diff", "-w", "done.go"}, exitUsage},
+		{[]string{"-w", "plain.go"}, exitOK},
+	} {
+		args := append([]string(nil), test.args...)
+		last := len(args) - 1
+		args[last] = filepath.Join(dir, args[last])
+		status, stdout, stderr := runCLI(t, "", args...)
+		if status != test.status {
+			t.Errorf("%q: got status %d, want %d", test.args, status,
+				test.status)
+		}
+		if test.status != exitOK && test.args[0] != "-l" &&
+			(stderr == "" || stdout != "") {
+			t.Errorf("%q: got stdout %q and stderr %q, want only an error",
+				test.args, stdout, stderr)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": plainSource, "b.go": ctxSource, "c.go": badSource})
+	metrics := filepath.Join(dir, "metrics.txt")
+	runCLI(t, "", "-w", "-metrics", metrics, filepath.Join(dir, "a.go"),
+		filepath.Join(dir, "b.go"), filepath.Join(dir, "c.go"))
+	got := readFile(t, metrics)
+	for _, want := range []string{
+		"# TYPE ctxrewriter_files_processed counter\n",
+		"\nctxrewriter_files_processed 2\n",
+		"\nctxrewriter_funcs_modified 2\n",
+		"\nctxrewriter_calls_modified 1\n",
+		"\nctxrewriter_files_skipped 1\n",
+		"\nctxrewriter_errors 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestOnlyPackage(t *testing.T) {
+	other := strings.Replace(plainSource, "package p", "package q", 1)
+	dir := writeFiles(t, map[string]string{
+		"p/a.go": plainSource, "q/b.go": other})
+	status, _, _ := runCLI(t, "", "-r", "-w", "-only-package", "p", dir)
+	if status != exitOK {
+		t.Errorf("got status %d, want %d", status, exitOK)
+	}
+	if got := readFile(t, filepath.Join(dir, "p/a.go")); got != ctxSource {
+		t.Errorf("p wasn't rewritten:\n%s", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "q/b.go")); got != other {
+		t.Errorf("q was rewritten:\n%s", got)
+	}
+}
+
+func TestFlagsFromEnv(t *testing.T) {
+	t.Setenv("CTXREWRITER_VAR", "c")
+	_, stdout, _ := runCLI(t, plainSource)
+	if !strings.Contains(stdout, "func run(c context.Context) { work(c) }") {
+		t.Errorf("CTXREWRITER_VAR wasn't applied:\n%s", stdout)
+	}
+
+	_, stdout, _ = runCLI(t, plainSource, "-var", "d")
+	if !strings.Contains(stdout, "func run(d context.Context) { work(d) }") {
+		t.Errorf("-var didn't override CTXREWRITER_VAR:\n%s", stdout)
+	}
+
+	t.Setenv("CTXREWRITER_PARAM_INDEX", "x")
+	status, _, stderr := runCLI(t, plainSource)
+	if status != exitUsage || !strings.HasPrefix(stderr,
+		"CTXREWRITER_PARAM_INDEX: ") {
+		t.Errorf("got status %d and %q for a bad value", status, stderr)
+	}
+}
+
+// fakeGit replaces git for the test with one that answers rev-parse with
+// dir, diff --cached with staged and diff with unstaged, and records the
+// files added.
+func fakeGit(t *testing.T, dir string, staged, unstaged []string) *[]string {
+	var added []string
+	saved := git
+	t.Cleanup(func() { git = saved })
+	git = func(args ...string) ([]byte, error) {
+		switch {
+		case args[0] == "rev-parse":
+			return []byte(dir + "\n"), nil
+		case args[0] == "diff" && len(args) > 1 && args[1] == "--cached":
+			return []byte(strings.Join(staged, "\n") + "\n"), nil
+		case args[0] == "diff":
+			return []byte(strings.Join(unstaged, "\n") + "\n"), nil
+		case args[0] == "add":
+			added = append(added, args[len(args)-1])
+			return nil, nil
+		}
+		t.Fatalf("unexpected git %v", args)
+		return nil, nil
+	}
+	return &added
+}
+
+func TestPreCommit(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": plainSource, "b.go": ctxSource, "c.txt": plainSource})
+	added := fakeGit(t, dir, []string{"a.go", "b.go", "c.txt"}, nil)
+	resetStatus(t)
+	changed, err := preCommit(ctxrewriter.Options{})
+	if err != nil || failed {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expected a change")
+	}
+	if got := readFile(t, filepath.Join(dir, "a.go")); got != ctxSource {
+		t.Errorf("a.go:\n%s", got)
+	}
+	want := []string{filepath.Join(dir, "a.go")}
+	if strings.Join(*added, ",") != strings.Join(want, ",") {
+		t.Errorf("added %v, want %v", *added, want)
+	}
+}
+
+func TestPreCommitUnstaged(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.go": plainSource})
+	added := fakeGit(t, dir, []string{"a.go"}, []string{"a.go"})
+	resetStatus(t)
+	changed, err := preCommit(ctxrewriter.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || !failed || fileErrors != 1 {
+		t.Errorf("changed %v, failed %v with %d errors", changed, failed,
+			fileErrors)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.go")); got != plainSource {
+		t.Errorf("a.go was rewritten:\n%s", got)
+	}
+	if len(*added) != 0 {
+		t.Errorf("added %v", *added)
+	}
+}
+
+func TestPreCommitContinues(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": badSource, "b.go": plainSource})
+	fakeGit(t, dir, []string{"a.go", "b.go"}, nil)
+	resetStatus(t)
+	changed, err := preCommit(ctxrewriter.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || !failed || fileErrors != 1 {
+		t.Errorf("changed %v, failed %v with %d errors", changed, failed,
+			fileErrors)
+	}
+	if got := readFile(t, filepath.Join(dir, "b.go")); got != ctxSource {
+		t.Errorf("b.go:\n%s", got)
+	}
+}
+
+// scriptedPrompter answers prompts from a script, recording the questions.
+type scriptedPrompter struct {
+	answers   []string
+	questions []string
+}
+
+func (p *scriptedPrompter) Prompt(question string) (string, error) {
+	p.questions = append(p.questions, question)
+	if len(p.answers) == 0 {
+		return "", io.EOF
+	}
+	answer := p.answers[0]
+	p.answers = p.answers[1:]
+	return answer, nil
+}
+
+func TestInteractive(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		answers []string
+		// applied lists the files that should be rewritten
+		applied   string
+		questions int
+	}{
+		{"yes and no", []string{"n", "y", "n"}, "c.go", 3},
+		{"all", []string{"maybe", "a"}, "a.go c.go d.go", 2},
+		{"quit", []string{"y", "q"}, "a.go", 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"a.go": plainSource,
+				"b.go": badSource, "c.go": plainSource, "d.go": plainSource,
+				"e.go": ctxSource})
+			var filenames []string
+			for _, name := range []string{"a.go", "b.go", "c.go", "d.go",
+				"e.go"} {
+				filenames = append(filenames, filepath.Join(dir, name))
+			}
+			resetStatus(t)
+			p := &scriptedPrompter{answers: test.answers}
+			err := interactive(filenames, ctxrewriter.Options{}, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !failed || fileErrors != 1 {
+				t.Errorf("failed %v with %d errors", failed, fileErrors)
+			}
+			if len(p.questions) != test.questions {
+				t.Errorf("asked %q", p.questions)
+			}
+			for _, name := range []string{"a.go", "c.go", "d.go"} {
+				want := plainSource
+				if strings.Contains(" "+test.applied+" ", " "+name+" ") {
+					want = ctxSource
+				}
+				if got := readFile(t, filepath.Join(dir, name)); got != want {
+					t.Errorf("%s:\n%s", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessLimited(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.go": badSource,
+		"b.go": ctxSource, "c.go": plainSource, "d.go": plainSource})
+	var filenames []string
+	for _, name := range []string{"d.go", "c.go", "b.go", "a.go"} {
+		filenames = append(filenames, filepath.Join(dir, name))
+	}
+	resetStatus(t)
+	saved := *inplaceFlag
+	defer func() { *inplaceFlag = saved }()
+	*inplaceFlag = true
+	processLimited(filenames, 1, ctxrewriter.Options{})
+	if !failed || fileErrors != 1 || filesProcessed != 3 {
+		t.Errorf("failed %v with %d errors, %d processed", failed,
+			fileErrors, filesProcessed)
+	}
+	// in path order, so c.go is the first needing changes
+	if got := readFile(t, filepath.Join(dir, "c.go")); got != ctxSource {
+		t.Errorf("c.go:\n%s", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "d.go")); got != plainSource {
+		t.Errorf("d.go:\n%s", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jtolds/ctxrewriter"
+)
+
+// git runs git with args and returns its standard output. It's a variable
+// so that the git interactions can be replaced.
+var git = func(args ...string) ([]byte, error) {
+	return exec.Command("git", args...).Output()
+}
+
+// preCommit rewrites the staged .go files in place and re-stages them, for
+// use as a git pre-commit hook. It reports whether anything changed, in
+// which case the hook should fail so that the commit is re-run with the
+// rewritten files. The working tree copies of the files are the ones
+// rewritten, so files needing changes that also have unstaged changes are
+// refused, since re-staging them would stage those changes too. Files that
+// can't be processed are reported with fileFailed and skipped.
+func preCommit(opts ctxrewriter.Options) (changed bool, err error) {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return false, err
+	}
+	root := strings.TrimSpace(string(top))
+	staged, err := git("diff", "--cached", "--name-only", "--diff-filter=ACM")
+	if err != nil {
+		return false, err
+	}
+	modified, err := git("diff", "--name-only")
+	if err != nil {
+		return false, err
+	}
+	unstaged := map[string]bool{}
+	for _, name := range strings.Split(string(modified), "\n") {
+		unstaged[name] = true
+	}
+	for _, name := range strings.Split(string(staged), "\n") {
+		if !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		filename := filepath.Join(root, name)
+		original, processed, err := ctxrewriter.ReadAndProcess(filename, opts)
+		if err != nil {
+			fileFailed(filename, err)
+			continue
+		}
+		if bytes.Equal(original, processed) {
+			continue
+		}
+		if unstaged[name] {
+			fileFailed(filename, errors.New(
+				"has unstaged changes; stage or stash them first"))
+			continue
+		}
+		err = ioutil.WriteFile(filename, processed, 0644)
+		if err == nil {
+			_, err = git("add", "--", filename)
+		}
+		if err != nil {
+			fileFailed(filename, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "rewrote %s\n", name)
+		changed = true
+	}
+	return changed, nil
+}
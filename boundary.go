@@ -0,0 +1,53 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+)
+
+// unreached returns the package's unexported functions and methods that
+// none of its exported ones refer to, directly or through other unexported
+// ones, for Options.BoundaryThread. This is purely syntactic: any use of a
+// name counts, not just calls, and a use of a method's name reaches every
+// method of that name, since the receiver's type isn't known. The methods
+// interfaces declare are always reached, since the interfaces gain ctx.
+func (s *symbols) unreached() []*ast.FuncDecl {
+	reached := map[string]bool{}
+	for typ := range s.ifaces {
+		for name := range s.methods[typ] {
+			reached[name] = true
+		}
+	}
+	var pending []*ast.FuncDecl
+	for _, fn := range s.decls {
+		if fn.Name.IsExported() {
+			pending = append(pending, fn)
+		}
+	}
+	visited := map[*ast.FuncDecl]bool{}
+	for len(pending) > 0 {
+		fn := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[fn] || fn.Body == nil {
+			continue
+		}
+		visited[fn] = true
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok {
+				reached[ident.Name] = true
+			}
+			return true
+		})
+		for _, other := range s.decls {
+			if !visited[other] && reached[other.Name.Name] {
+				pending = append(pending, other)
+			}
+		}
+	}
+	var list []*ast.FuncDecl
+	for _, fn := range s.decls {
+		if !fn.Name.IsExported() && !reached[fn.Name.Name] {
+			list = append(list, fn)
+		}
+	}
+	return list
+}
@@ -0,0 +1,240 @@
+package ctxrewriter
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BuildError is a single compiler error, as parsed from `go build` output.
+type BuildError struct {
+	Filename string
+	Line     int
+	Column   int
+	Msg      string
+}
+
+var buildErrorRE = regexp.MustCompile(`^(.+\.go):(\d+):(\d+): (.*)$`)
+
+// ParseBuildErrors extracts the "not enough arguments" and "too many
+// arguments" errors from `go build` output. Other errors are ignored.
+func ParseBuildErrors(output []byte) []BuildError {
+	var errs []BuildError
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := buildErrorRE.FindStringSubmatch(scanner.Text())
+		if m == nil || (!strings.HasPrefix(m[4], "not enough arguments") &&
+			!strings.HasPrefix(m[4], "too many arguments")) {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		column, _ := strconv.Atoi(m[3])
+		errs = append(errs, BuildError{
+			Filename: m[1], Line: line, Column: column, Msg: m[4]})
+	}
+	return errs
+}
+
+// ProcessErrors applies ctx injection or removal only at the calls named by
+// errs, instead of rewriting whole files. A "not enough arguments" error
+// gains a ctx argument, and a "too many arguments" error loses its ctx
+// argument. This is useful for converging a half-migrated codebase. opts
+// sets the ctx variable's name, the context package to import and where
+// among the arguments ctx goes, and the files are formatted as they are by
+// ProcessFileWith.
+func ProcessErrors(errs []BuildError, inplace bool, opts Options) error {
+	if err := CheckOptions(opts); err != nil {
+		return err
+	}
+	var filenames []string
+	byFile := map[string][]BuildError{}
+	for _, e := range errs {
+		if _, ok := byFile[e.Filename]; !ok {
+			filenames = append(filenames, e.Filename)
+		}
+		byFile[e.Filename] = append(byFile[e.Filename], e)
+	}
+	for _, filename := range filenames {
+		source, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		processed, err := processErrors(filename, source, byFile[filename],
+			opts)
+		if err != nil {
+			return err
+		}
+		if inplace {
+			err = ioutil.WriteFile(filename, processed, 0644)
+		} else {
+			_, err = os.Stdout.Write(processed)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processErrors fixes the calls in source, the contents of filename, that
+// errs name.
+func processErrors(filename string, source []byte, errs []BuildError,
+	opts Options) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, source, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	r := newRewriter(fset, opts)
+	if name, ok := opts.VarNameByPackage[f.Name.Name]; ok {
+		r.varName, r.name = name, name
+	}
+	r.imports = fileImports(f)
+	r.pkgName, r.hasImport = contextImportName(f, r.importPath())
+	r.symbols = packageSymbols(f, filename, "")
+
+	tfile := fset.File(f.Pos())
+	needImport := false
+	for _, e := range errs {
+		if e.Line < 1 || e.Line > tfile.LineCount() {
+			continue
+		}
+		pos := tfile.LineStart(e.Line) + token.Pos(e.Column-1)
+		call, inScope := callAt(f, pos, callee(e.Msg), r.varName)
+		if call == nil {
+			continue
+		}
+		if strings.HasPrefix(e.Msg, "not enough arguments") {
+			r.inScope = inScope
+			needImport = needImport || !inScope
+			index := r.argIndex(call, len(call.Args))
+			call.Args = append(call.Args[:index:index],
+				append([]ast.Expr{r.ctxArg()}, call.Args[index:]...)...)
+		} else if index := r.addedArgIndex(call); index >= 0 &&
+			isCtxArg(call.Args[index], r.varName, r.pkgName) {
+			call.Args = append(call.Args[:index:index],
+				call.Args[index+1:]...)
+		}
+	}
+	if needImport && !r.hasImport {
+		f.Decls = addImport(f.Decls, importPos(fset, f), r.importPath())
+	}
+	if !opts.KeepUnusedImports {
+		f.Decls = pruneContextImports(f.Decls, r.importPath())
+	}
+	return printFile(fset, f, opts, nil)
+}
+
+// callAt returns the call expression that the error at pos is about, and
+// whether a ctx parameter called name is in scope at that call. go reports
+// a call's first extra argument or its last argument, so the call whose
+// argument list starts an argument at pos wins over a call nested in that
+// argument. When callee, the called expression as the error names it,
+// matches some call containing pos, only those calls are considered.
+func callAt(f *ast.File, pos token.Pos, callee, name string) (
+	call *ast.CallExpr, inScope bool) {
+	type candidate struct {
+		call    *ast.CallExpr
+		inScope bool
+	}
+	var candidates []candidate
+	var stack []ast.Node
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return false
+		}
+		if pos < n.Pos() || pos > n.End() {
+			return false
+		}
+		stack = append(stack, n)
+		if c, ok := n.(*ast.CallExpr); ok {
+			found := candidate{call: c}
+			for _, s := range stack {
+				if ft := funcTypeOf(s); ft != nil && hasCtxParam(ft, name) {
+					found.inScope = true
+				}
+			}
+			candidates = append(candidates, found)
+		}
+		return true
+	})
+	var named []candidate
+	for _, c := range candidates {
+		if types.ExprString(c.call.Fun) == callee {
+			named = append(named, c)
+		}
+	}
+	if len(named) > 0 {
+		candidates = named
+	}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		for _, arg := range candidates[i].call.Args {
+			if arg.Pos() == pos {
+				return candidates[i].call, candidates[i].inScope
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	last := candidates[len(candidates)-1]
+	return last.call, last.inScope
+}
+
+// callee returns the called expression named by a "... in call to X" build
+// error message, or "" if there is none.
+func callee(msg string) string {
+	if i := strings.Index(msg, " in call to "); i >= 0 {
+		return msg[i+len(" in call to "):]
+	}
+	return ""
+}
+
+func funcTypeOf(n ast.Node) *ast.FuncType {
+	switch v := n.(type) {
+	case *ast.FuncDecl:
+		return v.Type
+	case *ast.FuncLit:
+		return v.Type
+	}
+	return nil
+}
+
+func hasCtxParam(ft *ast.FuncType, name string) bool {
+	for _, field := range ft.Params.List {
+		for _, param := range field.Names {
+			if param.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCtxArg reports whether expr is the ctx identifier name or a
+// Background() or TODO() call qualified by pkg, the context package's name,
+// as inserted by the rewriter.
+func isCtxArg(expr ast.Expr, name, pkg string) bool {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		return v.Name == name
+	case *ast.CallExpr:
+		sel, ok := v.Fun.(*ast.SelectorExpr)
+		if !ok || len(v.Args) != 0 {
+			return false
+		}
+		x, ok := sel.X.(*ast.Ident)
+		return ok && x.Name == pkg &&
+			(sel.Sel.Name == "Background" || sel.Sel.Name == "TODO")
+	}
+	return false
+}
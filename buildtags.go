@@ -0,0 +1,50 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/build/constraint"
+)
+
+// satisfiesTags reports whether the build constraints in f's header allow it
+// to be built with the given tags. A //go:build line takes precedence over
+// // +build lines, as with the go command. Files without constraints always
+// satisfy them. File name suffixes like _linux.go are not considered.
+func satisfiesTags(f *ast.File, tags []string) (bool, error) {
+	set := map[string]bool{}
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	has := func(tag string) bool { return set[tag] }
+
+	var goBuild constraint.Expr
+	var plusBuild []constraint.Expr
+	for _, group := range f.Comments {
+		if group.Pos() >= f.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if !constraint.IsGoBuild(comment.Text) &&
+				!constraint.IsPlusBuild(comment.Text) {
+				continue
+			}
+			expr, err := constraint.Parse(comment.Text)
+			if err != nil {
+				return false, err
+			}
+			if constraint.IsGoBuild(comment.Text) {
+				goBuild = expr
+			} else {
+				plusBuild = append(plusBuild, expr)
+			}
+		}
+	}
+	if goBuild != nil {
+		return goBuild.Eval(has), nil
+	}
+	for _, expr := range plusBuild {
+		if !expr.Eval(has) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
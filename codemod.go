@@ -0,0 +1,123 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CodemodVersion is the version of the Codemod schema. It changes only if
+// the schema changes incompatibly.
+const CodemodVersion = 1
+
+// Codemod describes the exported functions and methods whose signatures
+// gained a ctx parameter, for tools that update callers outside Go, such as
+// generated clients or RPC stubs. Marshaled as JSON, it looks like:
+//
+//	{
+//	  "version": 1,
+//	  "changes": [
+//	    {
+//	      "package": "store",
+//	      "receiver": "*DB",
+//	      "name": "Get",
+//	      "old": "Get(key string) ([]byte, error)",
+//	      "new": "Get(ctx context.Context, key string) ([]byte, error)",
+//	      "param": {"index": 0, "name": "ctx", "import": "context"}
+//	    }
+//	  ]
+//	}
+//
+// Changes are sorted by package, receiver and name.
+type Codemod struct {
+	Version int             `json:"version"`
+	Changes []CodemodChange `json:"changes"`
+}
+
+// CodemodChange is the change to one exported function's signature.
+type CodemodChange struct {
+	// Package is the name of the function's package.
+	Package string `json:"package"`
+	// Receiver is the receiver type, like "*DB", or empty for a function.
+	Receiver string `json:"receiver,omitempty"`
+	Name     string `json:"name"`
+	// Old and New are the signatures before and after, written like
+	// "Get(key string) ([]byte, error)".
+	Old   string       `json:"old"`
+	New   string       `json:"new"`
+	Param CodemodParam `json:"param"`
+}
+
+// CodemodParam is the parameter a function gained.
+type CodemodParam struct {
+	// Index is the parameter's position, counting from 0.
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	// Import is the import path of the parameter's context package.
+	Import string `json:"import"`
+}
+
+// Codemod returns the exported signature changes the report collected.
+func (r *Report) Codemod() Codemod {
+	changes := append([]CodemodChange{}, r.codemod...)
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.Receiver != b.Receiver {
+			return a.Receiver < b.Receiver
+		}
+		return a.Name < b.Name
+	})
+	return Codemod{Version: CodemodVersion, Changes: changes}
+}
+
+// reportCodemod records the change of fn's signature to newType for
+// Report.Codemod, if fn is exported.
+func (r *rewriter) reportCodemod(fn *ast.FuncDecl, change SignatureChange,
+	newType *ast.FuncType) {
+	for _, part := range strings.Split(funcName(fn), ".") {
+		if !ast.IsExported(part) {
+			return
+		}
+	}
+	var receiver string
+	if fn.Recv != nil && len(fn.Recv.List) > 0 {
+		receiver = types.ExprString(fn.Recv.List[0].Type)
+	}
+	index := 0
+	for _, field := range newType.Params.List {
+		if len(field.Names) > 0 && field.Names[0].Pos() == token.NoPos {
+			break
+		}
+		index += len(field.Names)
+	}
+	r.opts.Report.codemod = append(r.opts.Report.codemod, CodemodChange{
+		Package:  r.packageName,
+		Receiver: receiver,
+		Name:     fn.Name.Name,
+		Old:      change.Old,
+		New:      change.New,
+		Param: CodemodParam{Index: index, Name: r.name,
+			Import: r.paramImport()},
+	})
+}
+
+// paramImport returns the import path of the context package the new ctx
+// parameters refer to: the file's existing import, if it's reused, as
+// migrated under StdlibContext, or else the import added.
+func (r *rewriter) paramImport() string {
+	quoted := r.importPath()
+	if path, ok := r.imports[r.pkgName]; ok && r.hasImport {
+		quoted = strconv.Quote(path)
+		if r.opts.StdlibContext && quoted == netContextImport {
+			quoted = stdlibContextImport
+		}
+	}
+	path, _ := strconv.Unquote(quoted)
+	return path
+}
@@ -0,0 +1,51 @@
+package ctxrewriter
+
+import (
+	"fmt"
+	"go/ast"
+)
+
+// inconsistencies checks the rewritten file f for calls that disagree with
+// the rewritten definitions of the file's own top-level functions: a call
+// without ctx to a function that gained a ctx parameter, or a call that
+// gained ctx to a function that didn't. These come from options that rewrite
+// definitions and calls differently, such as TargetLines or OnlyCallsTo.
+func (r *rewriter) inconsistencies(f *ast.File) []Problem {
+	rewritten := map[string]bool{}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+			rewritten[fn.Name.Name] = addedParam(fn.Type)
+		}
+	}
+	var problems []Problem
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := call.Fun.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		gained, local := rewritten[ident.Name]
+		if !local {
+			return true
+		}
+		var msg string
+		index := r.addedArgIndex(call)
+		if gained && (index < 0 ||
+			!isCtxArg(call.Args[index], r.varName, r.pkgName)) {
+			msg = fmt.Sprintf("%s takes %s now, but this call doesn't pass it",
+				ident.Name, r.varName)
+		} else if !gained && addedArg(call) >= 0 {
+			msg = fmt.Sprintf("this call passes %s, but %s doesn't take it",
+				r.varName, ident.Name)
+		}
+		if msg != "" {
+			problems = append(problems, Problem{
+				Pos: r.fset.Position(call.Pos()), Msg: msg})
+		}
+		return true
+	})
+	return problems
+}
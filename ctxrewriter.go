@@ -1,379 +1,1525 @@
 // package ctxrewriter rewrites go source by adding a `ctx context.Context`
 // argument to the beginning of every function definition, and by adding a
 // `ctx` argument to the beginning of every function call.
+//
+// Options.BoundaryThread narrows this to the "boundary thread" migration
+// strategy: exported functions gain ctx as the package's API boundary, and
+// the unexported functions they call gain it too, so ctx threads unbroken
+// from the boundary through the package's internals, while unexported
+// functions the boundary never reaches are left alone. Options such as
+// LeafFuncs, SkipFuncValues and TargetLines carve exceptions out of either.
 package ctxrewriter
 
 import (
 	"bytes"
+	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"go/types"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 )
 
+// Version is the version of ctxrewriter, as recorded by
+// Options.StampVersion.
+const Version = "v0.1"
+
 const (
 	ctxVariable = "ctx"
+
+	versionStampPrefix = "// ctxrewriter: "
+
+	netContextImport    = `"golang.org/x/net/context"`
+	stdlibContextImport = `"context"`
 )
 
-func rewriteExprs(exprs []ast.Expr) []ast.Expr {
+// builtins are the predeclared functions, which never take ctx. A function
+// declared in the file with one of these names shadows it and is treated like
+// any other function, but shadowing by local variables or by declarations in
+// the package's other files isn't detected.
+var builtins = map[string]bool{
+	"append": true, "cap": true, "clear": true, "close": true,
+	"complex": true, "copy": true, "delete": true, "imag": true, "len": true,
+	"make": true, "max": true, "min": true, "new": true, "panic": true,
+	"print": true, "println": true, "real": true, "recover": true,
+}
+
+// predeclaredTypes are the predeclared type names. Calling one is a
+// conversion, like int(x), and file-level declarations shadow them just as
+// they do builtins.
+var predeclaredTypes = map[string]bool{
+	"any": true, "bool": true, "byte": true, "comparable": true,
+	"complex64": true, "complex128": true, "error": true, "float32": true,
+	"float64": true, "int": true, "int8": true, "int16": true, "int32": true,
+	"int64": true, "rune": true, "string": true, "uint": true, "uint8": true,
+	"uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+}
+
+// gofmtConfig is the printer configuration gofmt uses.
+var gofmtConfig = printer.Config{
+	Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+
+// Options controls optional rewriting behavior. The zero value is the
+// default behavior.
+type Options struct {
+	// BackgroundGoroutines, if true, launches goroutine closures
+	// (`go func() { ... }()`) with context.Background() instead of the
+	// enclosing ctx, so the goroutine isn't tied to the caller's lifetime.
+	BackgroundGoroutines bool
+
+	// ImportPath is the import path of the context package to use, the
+	// standard library's "context" if unset, e.g. golang.org/x/net/context
+	// for code that predates it. The package must export a Context type,
+	// and a Background function for calls made where no ctx is in scope.
+	ImportPath string
+
+	// Fallback, if set, names the context package function ("Background"
+	// or "TODO") whose result is passed by calls made where no ctx is in
+	// scope, such as in package-level var initializers or init. The
+	// default is "Background"; "TODO" marks those calls as needing a real
+	// ctx later.
+	Fallback string
+
+	// VarName, if set, is the name to give ctx parameters instead of "ctx".
+	// VarNameByPackage overrides it.
+	VarName string
+
+	// ParamIndex is the position among a function's parameters at which
+	// ctx is added, and likewise among the arguments of calls, for APIs
+	// that want something else first, like a *sql.Tx. Functions and calls
+	// with fewer parameters or arguments get ctx last.
+	ParamIndex int
+
+	// SkipDefinitions, if true, leaves function signatures alone, only
+	// adding ctx to calls, for code whose functions already take ctx.
+	// Calls in functions that don't take it get context.Background() (or
+	// Fallback) instead.
+	SkipDefinitions bool
+
+	// SkipCalls, if true, leaves calls alone, only adding ctx parameters.
+	SkipCalls bool
+
+	// StdlibContext, if true, migrates existing golang.org/x/net/context
+	// imports to the standard library "context" package. Otherwise they
+	// are reused as they are.
+	StdlibContext bool
+
+	// StampVersion, if true, records the ctxrewriter version in a
+	// `// ctxrewriter: vX.Y` comment after the package clause, replacing
+	// any stamp left by a previous run.
+	StampVersion bool
+
+	// DocumentCtx, if true, adds a line documenting the ctx parameter to the
+	// doc comment of each function that gains one, creating the doc comment
+	// if there isn't one.
+	DocumentCtx bool
+
+	// TargetLines, if non-nil, restricts rewriting to the function
+	// declarations starting on the listed lines, keyed by filename. Other
+	// declarations are left untouched.
+	TargetLines map[string][]int
+
+	// VarNameByPackage maps package names to the name to use for the ctx
+	// variable in that package's files, instead of "ctx".
+	VarNameByPackage map[string]string
+
+	// KeepUnusedImports, if true, keeps context imports that are unused
+	// after rewriting. By default they are removed, since they wouldn't
+	// compile.
+	KeepUnusedImports bool
+
+	// BoundaryThread, if true, only adds ctx to exported functions and
+	// methods and to the unexported ones they refer to, directly or through
+	// others, across the package if it's known. The signatures of (and
+	// calls to) unexported functions and methods only reached otherwise,
+	// e.g. from init or package-level variables, are left alone.
+	BoundaryThread bool
+
+	// SkipFuncValues, if true, leaves the signatures of (and calls to)
+	// top-level functions that are also used as values, e.g. assigned to a
+	// variable or passed as a callback, unchanged, since adding ctx would
+	// break those uses. A warning is added to the Report for each.
+	SkipFuncValues bool
+
+	// WarnUnusedCtx, if true, adds a warning to the Report for each function
+	// that gains a ctx parameter it never uses, which some linters flag.
+	WarnUnusedCtx bool
+
+	// SilenceUnused, if true, adds `_ = ctx` to the top of each function
+	// that gains a ctx parameter it never uses, so linters stay quiet.
+	SilenceUnused bool
+
+	// SkipTypeDecls, if true, leaves func types that are used as types
+	// unchanged, such as in struct fields, interface methods, type
+	// declarations, or chan and map element types. Only the signatures of
+	// function declarations and function literals gain ctx.
+	SkipTypeDecls bool
+
+	// LeafFuncs names top-level functions, such as pure helpers, that
+	// shouldn't take ctx: their signatures are left alone and calls to them
+	// don't gain a ctx argument.
+	LeafFuncs []string
+
+	// ExemptMethods lists method signatures, like "String() string" or
+	// "ServeHTTP(http.ResponseWriter, *http.Request)", of methods that must
+	// keep their signatures to satisfy an interface. Methods and interface
+	// methods with exactly one of these signatures don't gain ctx, and
+	// neither do method calls with the same name and number of arguments.
+	// If nil, DefaultExemptMethods is used; to exempt nothing, use an empty
+	// list.
+	ExemptMethods []string
+
+	// OnlyPackage, if set, restricts rewriting to files in the package of
+	// that name. Files in other packages are returned unchanged.
+	OnlyPackage string
+
+	// Tags, if non-nil, restricts rewriting to files whose build constraints
+	// are satisfied by these build tags (e.g. "linux", "amd64"). Other files
+	// are returned unchanged.
+	Tags []string
+
+	// OnlyCallsTo, if non-nil, restricts the calls that gain a ctx argument
+	// to calls to the named functions, given either in full (e.g.
+	// "db.Fetch") or by final name ("Fetch"). Function definitions are
+	// still rewritten as usual.
+	OnlyCallsTo []string
+
+	// ModulePath, if set, is the path of the module being rewritten (see
+	// the ModulePath function). Calls to functions of imported packages
+	// then only gain ctx if the package is part of that module, or is an
+	// internal package.
+	ModulePath string
+
+	// AllowPackages, if non-nil, restricts the calls to functions of
+	// imported packages that gain ctx to those of the packages it matches,
+	// and DenyPackages keeps calls to functions of the packages it matches
+	// from gaining ctx. The patterns are import paths, where a trailing
+	// "/..." matches the path and anything under it (e.g. "myorg/...").
+	// Calls to the file's own functions and to methods aren't affected.
+	AllowPackages []string
+	DenyPackages  []string
+
+	// OnlyPackageCalls, if true, restricts the calls that gain ctx to calls
+	// to the package's own functions and methods: those declared in the
+	// file, or in the other files of its package in the same directory
+	// when it's read by ReadAndProcess or ProcessFileWith. A method call
+	// x.M() counts if M is a method of the receiver's type, when x is the
+	// enclosing method's receiver, or of any of the package's types
+	// otherwise. Calls to imported packages, builtins and function-typed
+	// variables are left alone, as are calls that TypeCheck shows are to
+	// variables or fields.
+	OnlyPackageCalls bool
+
+	// packageDir is the directory of the file being rewritten, for
+	// OnlyPackageCalls and BoundaryThread.
+	packageDir string
+
+	// Strict, if true, makes rewriting fail on any call that can't be
+	// confidently classified as a call to a function defined in the same
+	// file or in a package of ModulePath (such as calls to methods or
+	// variables holding functions), instead
+	// of guessing that it takes ctx. Use LeafFuncs to classify calls that
+	// shouldn't take ctx.
+	Strict bool
+
+	// Ambiguous, if true, makes Analyze also report each call that would
+	// gain ctx but can't be classified as local, like method calls or calls
+	// of function variables, so reviewers know which to double-check. It's
+	// a softer alternative to Strict.
+	Ambiguous bool
+
+	// Printer, if non-nil, is used to print the output instead of gofmt's
+	// printer configuration, and the output is used as printed rather than
+	// being reformatted with go/format.
+	Printer *printer.Config
+
+	// IndentSpaces, if positive, replaces each leading tab of the output
+	// with that many spaces, for shops that don't indent with tabs.
+	IndentSpaces int
+
+	// MaxLineWidth, if positive, breaks output lines longer than that many
+	// columns (with tabs at the printer's tab width) after a comma between
+	// the arguments of a call or the parameters of a function, where there
+	// is one. go/printer itself never wraps lines.
+	MaxLineWidth int
+
+	// Validate, if true, checks that within each file, calls to the file's
+	// functions agree with their rewritten definitions, adding a warning to
+	// the Report for each call that doesn't.
+	Validate bool
+
+	// TypeCheck, if true, type-checks each file to recognize conversions to
+	// named types, like MyType(v), which otherwise look like calls and gain
+	// ctx. Only the file itself and its imports are available to the
+	// checker, so types declared in the package's other files are still
+	// missed.
+	TypeCheck bool
+
+	// Report, if non-nil, is filled in with details of the rewrite.
+	Report *Report
+}
+
+// CheckOptions checks that opts make sense, such as that any ctx variable
+// names are valid identifiers. Rewriting with opts fails the same way if
+// they don't; this lets callers check up front.
+func CheckOptions(opts Options) error {
+	names := []string{opts.VarName}
+	for _, name := range opts.VarNameByPackage {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if name != "" && (!token.IsIdentifier(name) || name == "_") {
+			return fmt.Errorf("invalid ctx variable name %q", name)
+		}
+	}
+	if opts.Fallback != "" && opts.Fallback != "Background" &&
+		opts.Fallback != "TODO" {
+		return fmt.Errorf("invalid fallback %q; want Background or TODO",
+			opts.Fallback)
+	}
+	if opts.ParamIndex < 0 {
+		return fmt.Errorf("invalid ctx parameter index %d", opts.ParamIndex)
+	}
+	for _, sig := range opts.ExemptMethods {
+		if _, _, err := parseMethodSignature(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rewriter struct {
+	fset *token.FileSet
+	opts Options
+
+	// inScope is true while walking a function body that has ctx available.
+	inScope bool
+
+	// varName is the name of the ctx variable for the current file, and name
+	// is the name of the ctx parameter being added or passed. They differ
+	// only inside a method whose receiver is already named varName.
+	varName string
+	name    string
+
+	// skipped holds the names of top-level functions whose signatures are
+	// left alone, and funcValues the subset of them skipped because of
+	// SkipFuncValues.
+	skipped    map[string]bool
+	funcValues map[string]bool
+
+	// skippedMethods maps the names of methods whose signatures are left
+	// alone, such as fenced-off ones, to their receivers' type names.
+	skippedMethods map[string]map[string]bool
+
+	// exemptSigs and exemptCalls are the method signatures and calls left
+	// alone because of Options.ExemptMethods.
+	exemptSigs  map[string]bool
+	exemptCalls map[string]bool
+
+	// localFuncs holds the names of the file's top-level functions, and
+	// imports maps the names of its imports to their paths.
+	localFuncs map[string]bool
+	imports    map[string]string
+
+	// rewrittenFuncs maps the indexes of the file's function declarations
+	// that gained ctx to the name of the parameter they gained.
+	rewrittenFuncs map[int]string
+
+	// err is the first error encountered, e.g. by Strict.
+	err error
+
+	// calls counts the calls that have gained a ctx argument, and params
+	// the function types that have gained a ctx parameter.
+	calls  int
+	params int
+
+	// fences are the current file's regions fenced off from rewriting by
+	// "// ctxrewriter:off" and "// ctxrewriter:on" comments.
+	fences []fence
+
+	// types, if TypeCheck is set, holds the current file's type
+	// information.
+	types *types.Info
+
+	// symbols holds the function and method names of the file, or with
+	// OnlyPackageCalls, of its whole package, and recvName and recvType are
+	// the receiver name and type of the method being walked, if any.
+	symbols  *symbols
+	recvName string
+	recvType string
+
+	// packageName is the name of the current file's package.
+	packageName string
+
+	// pkgName is the name the current file refers to the context package
+	// by, and hasImport is true if the file already imported it.
+	pkgName   string
+	hasImport bool
+}
+
+func newRewriter(fset *token.FileSet, opts Options) *rewriter {
+	name := ctxVariable
+	if opts.VarName != "" {
+		name = opts.VarName
+	}
+	r := &rewriter{fset: fset, opts: opts,
+		varName: name, name: name, pkgName: "context"}
+	r.exemptSigs, r.exemptCalls = exemptMethods(opts)
+	return r
+}
+
+// skip records that fn, a top-level function or method, keeps its
+// signature, so that calls to it don't gain ctx.
+func (r *rewriter) skip(fn *ast.FuncDecl) {
+	if fn.Recv == nil {
+		r.skipped[fn.Name.Name] = true
+		return
+	}
+	if r.skippedMethods[fn.Name.Name] == nil {
+		r.skippedMethods[fn.Name.Name] = map[string]bool{}
+	}
+	r.skippedMethods[fn.Name.Name][receiverType(fn)] = true
+}
+
+// targeted reports whether decl should be rewritten under
+// Options.TargetLines.
+func (r *rewriter) targeted(decl ast.Decl) bool {
+	if r.opts.TargetLines == nil {
+		return true
+	}
+	fn, ok := decl.(*ast.FuncDecl)
+	if !ok {
+		return false
+	}
+	pos := r.fset.Position(fn.Pos())
+	for filename, lines := range r.opts.TargetLines {
+		if filepath.Clean(filename) != filepath.Clean(pos.Filename) {
+			continue
+		}
+		for _, line := range lines {
+			if line == pos.Line {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *rewriter) importPath() string {
+	if r.opts.ImportPath != "" {
+		return strconv.Quote(r.opts.ImportPath)
+	}
+	return stdlibContextImport
+}
+
+// ctxArg returns the expression to pass as the new first argument of a call.
+// Outside of any function that takes ctx (e.g. package-level var
+// initializers), there is no ctx to pass, so context.Background() (or
+// Options.Fallback) is used.
+func (r *rewriter) ctxArg() ast.Expr {
+	if r.inScope {
+		return ast.NewIdent(r.name)
+	}
+	if r.opts.Fallback != "" {
+		return r.contextCall(r.opts.Fallback)
+	}
+	return r.background()
+}
+
+func (r *rewriter) background() ast.Expr {
+	return r.contextCall("Background")
+}
+
+// contextCall returns a call to the context package's function name.
+func (r *rewriter) contextCall(name string) ast.Expr {
+	return &ast.CallExpr{Fun: &ast.SelectorExpr{
+		X:   ast.NewIdent(r.pkgName),
+		Sel: ast.NewIdent(name)}}
+}
+
+// paramName returns the name to give the new ctx parameter of a method with
+// the given receiver. Normally this is r.varName, but a receiver already
+// named that would collide with it, so r.varName+"2" is used instead.
+func (r *rewriter) paramName(recv *ast.FieldList) string {
+	if recv != nil {
+		for _, field := range recv.List {
+			for _, name := range field.Names {
+				if name.Name == r.varName {
+					return r.varName + "2"
+				}
+			}
+		}
+	}
+	return r.varName
+}
+
+// takesCtx reports whether a call to fun should gain a ctx argument.
+func (r *rewriter) takesCtx(fun ast.Expr) bool {
+	if lit, ok := unparen(fun).(*ast.FuncLit); ok {
+		// fun is already rewritten, so it takes ctx only if it has it now
+		_, ok := r.ctxParam(lit.Type)
+		return ok
+	}
+	if ident, ok := uninstantiated(fun).(*ast.Ident); ok &&
+		(r.skipped[ident.Name] || ((builtins[ident.Name] ||
+			predeclaredTypes[ident.Name]) && !r.localFuncs[ident.Name])) {
+		return false
+	}
+	if path, ok := r.importedPackage(fun); ok && path == "unsafe" {
+		// unsafe's functions are builtins, and Pointer a type
+		return false
+	}
+	if r.opts.OnlyCallsTo != nil && !r.onlyCallsTo(fun) {
+		return false
+	}
+	if r.opts.OnlyPackageCalls && !r.packageCall(fun) {
+		return false
+	}
+	if r.opts.SkipTypeDecls && r.typedFuncValue(fun) {
+		return false
+	}
+	if path, ok := r.importedPackage(fun); ok && r.opts.ModulePath != "" &&
+		!r.ownPackage(path) {
+		return false
+	}
+	if path, ok := r.importedPackage(fun); ok &&
+		(matchPackages(r.opts.DenyPackages, path) ||
+			(r.opts.AllowPackages != nil &&
+				!matchPackages(r.opts.AllowPackages, path))) {
+		return false
+	}
+	// a conversion like []byte(s) or (func(int))(fn)
+	return !isTypeLiteral(fun)
+}
+
+// onlyCallsTo reports whether fun is named by Options.OnlyCallsTo, either by
+// its full expression (e.g. "db.Fetch") or by its final name ("Fetch").
+func (r *rewriter) onlyCallsTo(fun ast.Expr) bool {
+	full := types.ExprString(fun)
+	name := full
+	if sel, ok := fun.(*ast.SelectorExpr); ok {
+		name = sel.Sel.Name
+	}
+	for _, target := range r.opts.OnlyCallsTo {
+		if target == full || target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// local reports whether fun is known to be a function defined in this file,
+// rather than e.g. a method or a function from another package.
+func (r *rewriter) local(fun ast.Expr) bool {
+	switch v := fun.(type) {
+	case *ast.FuncLit:
+		return true
+	case *ast.Ident:
+		return r.localFuncs[v.Name]
+	case *ast.ParenExpr:
+		return r.local(v.X)
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return r.local(uninstantiated(v))
+	case *ast.SelectorExpr:
+		path, ok := r.importedPackage(v)
+		return ok && r.opts.ModulePath != "" && r.ownPackage(path)
+	}
+	return false
+}
+
+// uninstantiated returns the generic function fun instantiates, as with
+// Foo[int, string], or fun itself if it isn't an instantiation.
+func uninstantiated(fun ast.Expr) ast.Expr {
+	switch v := fun.(type) {
+	case *ast.IndexExpr:
+		return v.X
+	case *ast.IndexListExpr:
+		return v.X
+	}
+	return fun
+}
+
+// unparen returns expr without any parentheses around it.
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		paren, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.X
+	}
+}
+
+// fail records an error about node, if there isn't one already.
+func (r *rewriter) fail(node ast.Node, format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%s: %s", r.fset.Position(node.Pos()),
+			fmt.Sprintf(format, args...))
+	}
+}
+
+// isTypeLiteral reports whether expr is, syntactically, a type literal such
+// as []byte or func(int), possibly parenthesized, or a parenthesized
+// pointer to one or to a predeclared type or unsafe.Pointer, like (*int).
+// Calling one is a conversion, not a function call.
+func isTypeLiteral(expr ast.Expr) bool {
+	switch v := expr.(type) {
+	case *ast.ParenExpr:
+		return isTypeLiteral(v.X)
+	case *ast.StarExpr:
+		// otherwise, as in (*f)(x), it may be a call through a pointer to
+		// a func
+		return isTypeLiteral(v.X) || isPredeclaredType(v.X) ||
+			isUnsafePointer(v.X)
+	case *ast.ArrayType, *ast.ChanType, *ast.FuncType, *ast.InterfaceType,
+		*ast.MapType, *ast.StructType:
+		return true
+	}
+	return false
+}
+
+func isPredeclaredType(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && predeclaredTypes[ident.Name]
+}
+
+func isUnsafePointer(expr ast.Expr) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Pointer" {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return ok && x.Name == "unsafe"
+}
+
+// uses reports whether node refers to the identifier name anywhere.
+func uses(node ast.Node, name string) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && ident.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// rewriteBody rewrites a function body in which ctx is in scope.
+func (r *rewriter) rewriteBody(body *ast.BlockStmt) *ast.BlockStmt {
+	saved := r.inScope
+	r.inScope = true
+	defer func() { r.inScope = saved }()
+	return r.rewrite(body).(*ast.BlockStmt)
+}
+
+// rewriteCtxBody rewrites the body of a function that already takes ctx as
+// the parameter name, which is "" if the parameter is unnamed or blank. Calls
+// then get context.Background() instead, as there's no ctx to pass.
+func (r *rewriter) rewriteCtxBody(body *ast.BlockStmt,
+	name string) *ast.BlockStmt {
+	savedScope, savedName := r.inScope, r.name
+	defer func() { r.inScope, r.name = savedScope, savedName }()
+	r.inScope = name != ""
+	if name != "" {
+		r.name = name
+	}
+	return r.rewrite(body).(*ast.BlockStmt)
+}
+
+// ctxParam reports whether ft's parameter where ctx would have been added
+// is already a context.Context, as after an earlier rewrite, and returns its
+// name, or "" if it's unnamed or blank.
+func (r *rewriter) ctxParam(ft *ast.FuncType) (string, bool) {
+	if ft.Params == nil {
+		return "", false
+	}
+	index := r.addedIndex(ft.Params.NumFields(), variadic(ft.Params))
+	if index < 0 {
+		return "", false
+	}
+	n := 0
+	for _, field := range ft.Params.List {
+		count := len(field.Names)
+		if count == 0 {
+			count = 1
+		}
+		if index >= n+count {
+			n += count
+			continue
+		}
+		if !r.contextType(field.Type) {
+			return "", false
+		}
+		if len(field.Names) == 0 || field.Names[index-n].Name == "_" {
+			return "", true
+		}
+		return field.Names[index-n].Name, true
+	}
+	return "", false
+}
+
+// contextType reports whether expr is a context package's Context type,
+// under whatever name the file imports the package: the one the rewrite
+// uses, the standard library's, or golang.org/x/net/context.
+func (r *rewriter) contextType(expr ast.Expr) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Context" {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	if x.Name == r.pkgName {
+		return true
+	}
+	path, ok := r.imports[x.Name]
+	if !ok {
+		return false
+	}
+	path = strconv.Quote(path)
+	return path == r.importPath() || path == stdlibContextImport ||
+		path == netContextImport
+}
+
+// ctxIndex returns the index at which ctx goes among n parameters or
+// arguments. If variadic, the last of them is a variadic parameter or an
+// argument spread with ..., which has to stay last, so ctx goes before it.
+func (r *rewriter) ctxIndex(n int, variadic bool) int {
+	if variadic {
+		n--
+	}
+	if r.opts.ParamIndex < n {
+		return r.opts.ParamIndex
+	}
+	return n
+}
+
+// addedIndex returns the index at which ctx would be among n parameters or
+// arguments that already include it, or -1 if there's no room for it.
+func (r *rewriter) addedIndex(n int, variadic bool) int {
+	return r.ctxIndex(n-1, variadic)
+}
+
+// argIndex returns the index at which ctx goes among n arguments of call,
+// which come before any variadic ones if call is to one of the package's
+// variadic functions.
+func (r *rewriter) argIndex(call *ast.CallExpr, n int) int {
+	spread := call.Ellipsis.IsValid()
+	index := r.ctxIndex(n, spread)
+	if fixed, ok := r.fixedArgs(call.Fun); ok && !spread && index > fixed {
+		return fixed
+	}
+	return index
+}
+
+// addedArgIndex is argIndex for arguments that already include ctx.
+func (r *rewriter) addedArgIndex(call *ast.CallExpr) int {
+	return r.argIndex(call, len(call.Args)-1)
+}
+
+// variadic reports whether the last of params is variadic.
+func variadic(params *ast.FieldList) bool {
+	if params == nil || len(params.List) == 0 {
+		return false
+	}
+	_, ok := params.List[len(params.List)-1].Type.(*ast.Ellipsis)
+	return ok
+}
+
+// nameParams returns fields with any unnamed parameters named "_", since
+// adding the named ctx parameter to an unnamed list like func(int) would mix
+// named and unnamed parameters.
+func nameParams(fields []*ast.Field) []*ast.Field {
+	if len(fields) == 0 || len(fields[0].Names) > 0 {
+		return fields
+	}
+	new_fields := make([]*ast.Field, 0, len(fields))
+	for _, field := range fields {
+		c := *field
+		// positioned at the type, so as not to look added by the rewrite
+		c.Names = []*ast.Ident{{NamePos: field.Type.Pos(), Name: "_"}}
+		new_fields = append(new_fields, &c)
+	}
+	return new_fields
+}
+
+// insertParam returns fields with field inserted as the parameter at
+// index, splitting a field declaring several names if index falls within
+// it, or appended if there are fewer parameters.
+func insertParam(fields []*ast.Field, index int,
+	field *ast.Field) []*ast.Field {
+	new_fields := make([]*ast.Field, 0, len(fields)+2)
+	n := 0
+	for i, f := range fields {
+		count := len(f.Names)
+		if count == 0 {
+			count = 1
+		}
+		if index >= n+count {
+			new_fields = append(new_fields, f)
+			n += count
+			continue
+		}
+		if index > n {
+			before, after := *f, *f
+			before.Names = f.Names[:index-n]
+			after.Names = f.Names[index-n:]
+			new_fields = append(new_fields, &before, field, &after)
+		} else {
+			new_fields = append(new_fields, field, f)
+		}
+		return append(new_fields, fields[i+1:]...)
+	}
+	return append(new_fields, field)
+}
+
+// rewriteFuncType rewrites the parameter and result types of ft, prepending
+// the ctx parameter if addParam is true.
+func (r *rewriter) rewriteFuncType(ft *ast.FuncType,
+	addParam bool) *ast.FuncType {
+	c := *ft
+	if c.TypeParams != nil {
+		c.TypeParams = r.rewrite(c.TypeParams).(*ast.FieldList)
+	}
+	c.Params = r.rewrite(c.Params).(*ast.FieldList)
+	if addParam {
+		r.params++
+		c.Params.List = insertParam(nameParams(c.Params.List),
+			r.ctxIndex(c.Params.NumFields(), variadic(c.Params)),
+			&ast.Field{
+				Names: []*ast.Ident{ast.NewIdent(r.name)},
+				Type: &ast.SelectorExpr{
+					X:   ast.NewIdent(r.pkgName),
+					Sel: ast.NewIdent("Context")}})
+	}
+	if c.Results != nil {
+		c.Results = r.rewrite(c.Results).(*ast.FieldList)
+	}
+	return &c
+}
+
+func (r *rewriter) rewriteExprs(exprs []ast.Expr) []ast.Expr {
 	if exprs == nil {
 		return nil
 	}
 	new_exprs := make([]ast.Expr, 0, len(exprs))
 	for _, expr := range exprs {
-		new_exprs = append(new_exprs, rewrite(expr).(ast.Expr))
+		new_exprs = append(new_exprs, r.rewrite(expr).(ast.Expr))
 	}
 	return new_exprs
 }
 
-func rewriteStmts(stmts []ast.Stmt) []ast.Stmt {
+func (r *rewriter) rewriteStmts(stmts []ast.Stmt) []ast.Stmt {
 	if stmts == nil {
 		return nil
 	}
 	new_stmts := make([]ast.Stmt, 0, len(stmts))
 	for _, stmt := range stmts {
-		new_stmts = append(new_stmts, rewrite(stmt).(ast.Stmt))
+		new_stmts = append(new_stmts, r.rewrite(stmt).(ast.Stmt))
 	}
 	return new_stmts
 }
 
-func rewrite(node ast.Node) ast.Node {
+func (r *rewriter) rewrite(node ast.Node) ast.Node {
+	if r.fenced(node) {
+		return node
+	}
 	switch v := node.(type) {
 	default:
 		panic(node)
-	case *ast.ImportSpec, *ast.BasicLit, *ast.Ident,
+	case *ast.BasicLit, *ast.Ident,
 		*ast.BranchStmt, *ast.EmptyStmt:
 		return node
+	case *ast.BadDecl, *ast.BadExpr, *ast.BadStmt:
+		// the parser left these behind after a syntax error; keep them as
+		// they are and report the error rather than guess at their contents
+		r.fail(node, "syntax error")
+		return node
 
 	case *ast.ArrayType:
 		c := *v
 		if c.Len != nil {
-			c.Len = rewrite(c.Len).(ast.Expr)
+			c.Len = r.rewrite(c.Len).(ast.Expr)
 		}
-		c.Elt = rewrite(c.Elt).(ast.Expr)
+		c.Elt = r.rewrite(c.Elt).(ast.Expr)
 		return &c
 	case *ast.AssignStmt:
 		c := *v
-		c.Lhs = rewriteExprs(c.Lhs)
-		c.Rhs = rewriteExprs(c.Rhs)
+		c.Lhs = r.rewriteExprs(c.Lhs)
+		c.Rhs = r.rewriteExprs(c.Rhs)
 		return &c
 	case *ast.BinaryExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
-		c.Y = rewrite(c.Y).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
+		c.Y = r.rewrite(c.Y).(ast.Expr)
 		return &c
 	case *ast.BlockStmt:
 		c := *v
-		c.List = rewriteStmts(c.List)
+		c.List = r.rewriteStmts(c.List)
 		return &c
 	case *ast.CallExpr:
 		c := *v
-		c.Fun = rewrite(c.Fun).(ast.Expr)
-		c.Args = append([]ast.Expr{ast.NewIdent(ctxVariable)},
-			rewriteExprs(c.Args)...)
+		c.Fun = r.rewrite(c.Fun).(ast.Expr)
+		if r.opts.SkipCalls || !r.takesCtx(c.Fun) || r.isConversion(v.Fun) ||
+			r.exemptCall(v) {
+			c.Args = r.rewriteExprs(c.Args)
+			return &c
+		}
+		if r.opts.Strict && !r.local(c.Fun) {
+			r.fail(v, "cannot classify call to %s", types.ExprString(v.Fun))
+		}
+		arg := r.ctxArg()
+		new_args := r.rewriteExprs(c.Args)
+		// a call that already passes a ctx argument, whether the same one
+		// or a context.Background() or TODO(), is left alone, rather than
+		// becoming f(ctx, ctx, ...), so that rewriting again changes
+		// nothing.
+		if index := r.addedArgIndex(&c); index >= 0 &&
+			(types.ExprString(c.Args[index]) == types.ExprString(arg) ||
+				isCtxArg(c.Args[index], r.name, r.pkgName)) {
+			new_args[index] = c.Args[index]
+			c.Args = new_args
+			return &c
+		}
+		index := r.argIndex(&c, len(c.Args))
+		c.Args = append(new_args[:index:index],
+			append([]ast.Expr{arg}, new_args[index:]...)...)
+		r.calls++
 		return &c
 	case *ast.CaseClause:
 		c := *v
-		c.List = rewriteExprs(c.List)
-		c.Body = rewriteStmts(c.Body)
+		c.List = r.rewriteExprs(c.List)
+		c.Body = r.rewriteStmts(c.Body)
 		return &c
 	case *ast.ChanType:
 		c := *v
-		c.Value = rewrite(c.Value).(ast.Expr)
+		c.Value = r.rewrite(c.Value).(ast.Expr)
 		return &c
 	case *ast.CommClause:
 		c := *v
 		if c.Comm != nil {
-			c.Comm = rewrite(c.Comm).(ast.Stmt)
+			c.Comm = r.rewrite(c.Comm).(ast.Stmt)
 		}
-		c.Body = rewriteStmts(c.Body)
+		c.Body = r.rewriteStmts(c.Body)
 		return &c
 	case *ast.CompositeLit:
 		c := *v
 		if c.Type != nil {
-			c.Type = rewrite(c.Type).(ast.Expr)
+			c.Type = r.rewrite(c.Type).(ast.Expr)
 		}
-		c.Elts = rewriteExprs(c.Elts)
+		c.Elts = r.rewriteExprs(c.Elts)
 		return &c
 	case *ast.DeclStmt:
 		c := *v
-		c.Decl = rewrite(c.Decl).(ast.Decl)
+		c.Decl = r.rewrite(c.Decl).(ast.Decl)
 		return &c
 	case *ast.DeferStmt:
 		c := *v
-		c.Call = rewrite(c.Call).(*ast.CallExpr)
+		c.Call = r.rewrite(c.Call).(*ast.CallExpr)
 		return &c
 	case *ast.Ellipsis:
 		c := *v
 		if c.Elt != nil {
-			c.Elt = rewrite(c.Elt).(ast.Expr)
+			c.Elt = r.rewrite(c.Elt).(ast.Expr)
 		}
 		return &c
 	case *ast.ExprStmt:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		return &c
 	case *ast.Field:
 		c := *v
-		c.Type = rewrite(c.Type).(ast.Expr)
+		c.Type = r.rewrite(c.Type).(ast.Expr)
 		return &c
 	case *ast.FieldList:
 		c := *v
 		if c.List != nil {
 			new_list := make([]*ast.Field, 0, len(c.List))
 			for _, field := range c.List {
-				new_list = append(new_list, rewrite(field).(*ast.Field))
+				new_list = append(new_list, r.rewrite(field).(*ast.Field))
 			}
 			c.List = new_list
 		}
 		return &c
 	case *ast.File:
 		c := *v
+		if name, ok := r.opts.VarNameByPackage[c.Name.Name]; ok {
+			r.varName, r.name = name, name
+		}
+		r.packageName = c.Name.Name
+		if r.opts.TypeCheck {
+			r.types = typeInfo(r.fset, v)
+		}
+		r.imports = fileImports(v)
+		r.pkgName, r.hasImport = contextImportName(v, r.importPath())
+		r.symbols = packageSymbols(v,
+			r.fset.Position(v.Pos()).Filename, r.opts.packageDir)
+		r.localFuncs = map[string]bool{}
+		for _, decl := range c.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+				r.localFuncs[fn.Name.Name] = true
+			}
+		}
+		r.fences = fences(v)
+		r.skipped = map[string]bool{}
+		for _, name := range r.opts.LeafFuncs {
+			r.skipped[name] = true
+		}
+		// init, and main in package main, can't take parameters. Their
+		// bodies still get rewritten, with Background() for ctx.
+		r.skipped["init"] = true
+		if v.Name.Name == "main" {
+			r.skipped["main"] = true
+		}
+		// calls to fenced-off functions and methods mustn't gain ctx
+		// either, since their signatures won't.
+		r.skippedMethods = map[string]map[string]bool{}
+		for _, decl := range c.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && r.fenced(fn) {
+				r.skip(fn)
+			}
+		}
+		if r.opts.BoundaryThread {
+			for _, fn := range r.symbols.unreached() {
+				r.skip(fn)
+			}
+		}
+		if r.opts.SkipFuncValues {
+			r.funcValues = funcValues(v)
+			for name := range r.funcValues {
+				r.skipped[name] = true
+			}
+		}
+		calls, params := r.calls, r.params
 		new_decls := make([]ast.Decl, 0, len(c.Decls)+1)
-		new_decls = append(new_decls, &ast.GenDecl{
-			Tok: token.IMPORT,
-			Specs: []ast.Spec{
-				&ast.ImportSpec{Path: &ast.BasicLit{
-					Value: `"golang.org/x/net/context"`}}}})
+		r.rewrittenFuncs = map[int]string{}
+		funcIndex := 0
 		for _, decl := range c.Decls {
-			new_decls = append(new_decls, rewrite(decl).(ast.Decl))
+			fn, isFunc := decl.(*ast.FuncDecl)
+			if isFunc {
+				funcIndex++
+			}
+			if !r.targeted(decl) {
+				if isFunc {
+					r.reportFunc(fn, false, 0)
+				}
+				new_decls = append(new_decls, decl)
+				continue
+			}
+			new_decl := r.rewrite(decl).(ast.Decl)
+			if isFunc && addedParam(new_decl.(*ast.FuncDecl).Type) {
+				r.rewrittenFuncs[funcIndex-1] = r.paramName(fn.Recv)
+			}
+			new_decls = append(new_decls, new_decl)
+		}
+		// a file with nothing to rewrite, e.g. only type or const
+		// declarations, mustn't gain an unused import.
+		if !r.hasImport && (r.calls > calls || r.params > params) {
+			new_decls = addImport(new_decls, importPos(r.fset, v),
+				r.importPath())
 		}
 		c.Decls = new_decls
+		if !r.opts.KeepUnusedImports {
+			c.Decls = pruneContextImports(c.Decls, r.importPath())
+		}
+		r.reportImport(v, r.hasImport, hasImport(c.Decls, r.importPath()))
 		return &c
 	case *ast.ForStmt:
 		c := *v
 		if c.Init != nil {
-			c.Init = rewrite(c.Init).(ast.Stmt)
+			c.Init = r.rewrite(c.Init).(ast.Stmt)
 		}
 		if c.Cond != nil {
-			c.Cond = rewrite(c.Cond).(ast.Expr)
+			c.Cond = r.rewrite(c.Cond).(ast.Expr)
 		}
 		if c.Post != nil {
-			c.Post = rewrite(c.Post).(ast.Stmt)
+			c.Post = r.rewrite(c.Post).(ast.Stmt)
 		}
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
 		}
 		return &c
 	case *ast.FuncDecl:
 		c := *v
+		saved, savedRecv, savedType := r.name, r.recvName, r.recvType
+		defer func() {
+			r.name, r.recvName, r.recvType = saved, savedRecv, savedType
+		}()
+		r.name = r.paramName(c.Recv)
+		r.recvName, r.recvType = receiver(v)
+		calls := r.calls
+		if c.Recv == nil && r.skipped[c.Name.Name] {
+			if r.funcValues[c.Name.Name] {
+				r.warn(v, "%s is used as a value; not adding %s",
+					c.Name.Name, r.name)
+			}
+			if c.Body != nil {
+				c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
+			}
+			c.Type = r.rewriteFuncType(c.Type, false)
+			r.reportFunc(v, false, r.calls-calls)
+			return &c
+		}
+		if c.Recv != nil && r.keepsSignature(receiverType(v), c.Name.Name,
+			c.Type) {
+			if c.Body != nil {
+				c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
+			}
+			c.Type = r.rewriteFuncType(c.Type, false)
+			r.reportFunc(v, false, r.calls-calls)
+			return &c
+		}
+		if name, ok := r.ctxParam(c.Type); ok {
+			if c.Body != nil {
+				c.Body = r.rewriteCtxBody(c.Body, name)
+			}
+			c.Type = r.rewriteFuncType(c.Type, false)
+			r.reportFunc(v, false, r.calls-calls)
+			return &c
+		}
+		if r.opts.SkipDefinitions {
+			// ctx isn't a parameter, so there's none to pass on
+			if c.Body != nil {
+				c.Body = r.rewriteCtxBody(c.Body, "")
+			}
+			c.Type = r.rewriteFuncType(c.Type, false)
+			r.reportFunc(v, false, r.calls-calls)
+			return &c
+		}
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewriteBody(c.Body)
+			if !uses(c.Body, r.name) {
+				if r.opts.SilenceUnused {
+					c.Body.List = append([]ast.Stmt{&ast.AssignStmt{
+						Lhs: []ast.Expr{ast.NewIdent("_")},
+						Tok: token.ASSIGN,
+						Rhs: []ast.Expr{ast.NewIdent(r.name)}}},
+						c.Body.List...)
+				} else if r.opts.WarnUnusedCtx {
+					r.warn(v, "%s doesn't use its new %s parameter",
+						funcName(v), r.name)
+				}
+			}
 		}
-		c.Type = rewrite(c.Type).(*ast.FuncType)
+		c.Type = r.rewriteFuncType(c.Type, true)
+		r.reportFunc(v, true, r.calls-calls)
+		r.reportSignature(v, c.Type)
 		return &c
 	case *ast.FuncLit:
 		c := *v
-		c.Type = rewrite(c.Type).(*ast.FuncType)
+		if name, ok := r.ctxParam(c.Type); ok {
+			c.Type = r.rewriteFuncType(c.Type, false)
+			if c.Body != nil {
+				c.Body = r.rewriteCtxBody(c.Body, name)
+			}
+			return &c
+		}
+		if r.opts.SkipDefinitions {
+			// without a ctx parameter of its own, the literal can only use
+			// the ctx of the function it's in, if that has one
+			c.Type = r.rewriteFuncType(c.Type, false)
+			if c.Body != nil {
+				c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
+			}
+			return &c
+		}
+		c.Type = r.rewriteFuncType(c.Type, true)
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewriteBody(c.Body)
 		}
 		return &c
 	case *ast.FuncType:
-		c := *v
-		c.Params = rewrite(c.Params).(*ast.FieldList)
-		c.Params.List = append([]*ast.Field{{
-			Names: []*ast.Ident{ast.NewIdent(ctxVariable)},
-			Type: &ast.SelectorExpr{
-				X:   ast.NewIdent("context"),
-				Sel: ast.NewIdent("Context")}}}, c.Params.List...)
-		if c.Results != nil {
-			c.Results = rewrite(c.Results).(*ast.FieldList)
-		}
-		return &c
+		// not a function's own signature, but a func type used as a type
+		_, hasCtx := r.ctxParam(v)
+		return r.rewriteFuncType(v,
+			!r.opts.SkipTypeDecls && !r.opts.SkipDefinitions && !hasCtx)
 	case *ast.GenDecl:
 		c := *v
 		if c.Specs != nil {
 			new_specs := make([]ast.Spec, 0, len(c.Specs))
 			for _, spec := range c.Specs {
-				new_specs = append(new_specs, rewrite(spec).(ast.Spec))
+				new_specs = append(new_specs, r.rewrite(spec).(ast.Spec))
 			}
 			c.Specs = new_specs
 		}
 		return &c
 	case *ast.GoStmt:
 		c := *v
-		c.Call = rewrite(c.Call).(*ast.CallExpr)
+		c.Call = r.rewrite(c.Call).(*ast.CallExpr)
+		if lit, ok := c.Call.Fun.(*ast.FuncLit); ok &&
+			r.opts.BackgroundGoroutines && !r.opts.SkipCalls &&
+			r.takesCtx(lit) {
+			c.Call.Args[r.addedArgIndex(c.Call)] = r.background()
+		}
 		return &c
 	case *ast.IfStmt:
 		c := *v
 		if c.Init != nil {
-			c.Init = rewrite(c.Init).(ast.Stmt)
+			c.Init = r.rewrite(c.Init).(ast.Stmt)
 		}
 		if c.Cond != nil {
-			c.Cond = rewrite(c.Cond).(ast.Expr)
+			c.Cond = r.rewrite(c.Cond).(ast.Expr)
 		}
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
 		}
 		if c.Else != nil {
-			c.Else = rewrite(c.Else).(ast.Stmt)
+			c.Else = r.rewrite(c.Else).(ast.Stmt)
 		}
 		return &c
+	case *ast.ImportSpec:
+		if !r.opts.StdlibContext || v.Path.Value != netContextImport {
+			return node
+		}
+		c := *v
+		path := *c.Path
+		path.Value = stdlibContextImport
+		c.Path = &path
+		return &c
 	case *ast.IncDecStmt:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		return &c
 	case *ast.IndexExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
-		c.Index = rewrite(c.Index).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
+		c.Index = r.rewrite(c.Index).(ast.Expr)
+		return &c
+	case *ast.IndexListExpr:
+		c := *v
+		c.X = r.rewrite(c.X).(ast.Expr)
+		c.Indices = r.rewriteExprs(c.Indices)
 		return &c
 	case *ast.InterfaceType:
 		c := *v
-		c.Methods = rewrite(c.Methods).(*ast.FieldList)
+		methods := *c.Methods
+		methods.List = make([]*ast.Field, 0, len(c.Methods.List))
+		for _, method := range c.Methods.List {
+			ft, ok := method.Type.(*ast.FuncType)
+			if ok && len(method.Names) == 1 &&
+				r.exemptMethod(method.Names[0].Name, ft) {
+				exempt := *method
+				exempt.Type = r.rewriteFuncType(ft, false)
+				methods.List = append(methods.List, &exempt)
+				continue
+			}
+			methods.List = append(methods.List, r.rewrite(method).(*ast.Field))
+		}
+		c.Methods = &methods
 		return &c
 	case *ast.KeyValueExpr:
 		c := *v
-		c.Key = rewrite(c.Key).(ast.Expr)
-		c.Value = rewrite(c.Value).(ast.Expr)
+		c.Key = r.rewrite(c.Key).(ast.Expr)
+		c.Value = r.rewrite(c.Value).(ast.Expr)
 		return &c
 	case *ast.LabeledStmt:
 		c := *v
-		c.Stmt = rewrite(c.Stmt).(ast.Stmt)
+		c.Stmt = r.rewrite(c.Stmt).(ast.Stmt)
 		return &c
 	case *ast.MapType:
 		c := *v
-		c.Key = rewrite(c.Key).(ast.Expr)
-		c.Value = rewrite(c.Value).(ast.Expr)
+		c.Key = r.rewrite(c.Key).(ast.Expr)
+		c.Value = r.rewrite(c.Value).(ast.Expr)
 		return &c
 	case *ast.ParenExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		return &c
 	case *ast.RangeStmt:
 		c := *v
 		if c.Key != nil {
-			c.Key = rewrite(c.Key).(ast.Expr)
+			c.Key = r.rewrite(c.Key).(ast.Expr)
 		}
 		if c.Value != nil {
-			c.Value = rewrite(c.Value).(ast.Expr)
+			c.Value = r.rewrite(c.Value).(ast.Expr)
 		}
 		if c.X != nil {
-			c.X = rewrite(c.X).(ast.Expr)
+			c.X = r.rewrite(c.X).(ast.Expr)
 		}
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
 		}
 		return &c
 	case *ast.ReturnStmt:
 		c := *v
-		c.Results = rewriteExprs(c.Results)
+		c.Results = r.rewriteExprs(c.Results)
 		return &c
 	case *ast.SelectStmt:
 		c := *v
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
 		}
 		return &c
 	case *ast.SelectorExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		return &c
 	case *ast.SendStmt:
 		c := *v
 		if c.Chan != nil {
-			c.Chan = rewrite(c.Chan).(ast.Expr)
+			c.Chan = r.rewrite(c.Chan).(ast.Expr)
 		}
 		if c.Value != nil {
-			c.Value = rewrite(c.Value).(ast.Expr)
+			c.Value = r.rewrite(c.Value).(ast.Expr)
 		}
 		return &c
 	case *ast.SliceExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		if c.Low != nil {
-			c.Low = rewrite(c.Low).(ast.Expr)
+			c.Low = r.rewrite(c.Low).(ast.Expr)
 		}
 		if c.High != nil {
-			c.High = rewrite(c.High).(ast.Expr)
+			c.High = r.rewrite(c.High).(ast.Expr)
 		}
 		if c.Max != nil {
-			c.Max = rewrite(c.Max).(ast.Expr)
+			c.Max = r.rewrite(c.Max).(ast.Expr)
 		}
 		return &c
 	case *ast.StarExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		return &c
 	case *ast.StructType:
 		c := *v
-		c.Fields = rewrite(c.Fields).(*ast.FieldList)
+		c.Fields = r.rewrite(c.Fields).(*ast.FieldList)
 		return &c
 	case *ast.SwitchStmt:
 		c := *v
 		if c.Init != nil {
-			c.Init = rewrite(c.Init).(ast.Stmt)
+			c.Init = r.rewrite(c.Init).(ast.Stmt)
 		}
 		if c.Tag != nil {
-			c.Tag = rewrite(c.Tag).(ast.Expr)
+			c.Tag = r.rewrite(c.Tag).(ast.Expr)
 		}
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
 		}
 		return &c
 	case *ast.TypeAssertExpr:
 		c := *v
 		if c.X != nil {
-			c.X = rewrite(c.X).(ast.Expr)
+			c.X = r.rewrite(c.X).(ast.Expr)
 		}
 		if c.Type != nil {
-			c.Type = rewrite(c.Type).(ast.Expr)
+			c.Type = r.rewrite(c.Type).(ast.Expr)
 		}
 		return &c
 	case *ast.TypeSpec:
 		c := *v
-		c.Type = rewrite(c.Type).(ast.Expr)
+		c.Type = r.rewrite(c.Type).(ast.Expr)
 		return &c
 	case *ast.TypeSwitchStmt:
 		c := *v
 		if c.Init != nil {
-			c.Init = rewrite(c.Init).(ast.Stmt)
+			c.Init = r.rewrite(c.Init).(ast.Stmt)
 		}
 		if c.Assign != nil {
-			c.Assign = rewrite(c.Assign).(ast.Stmt)
+			c.Assign = r.rewrite(c.Assign).(ast.Stmt)
 		}
 		if c.Body != nil {
-			c.Body = rewrite(c.Body).(*ast.BlockStmt)
+			c.Body = r.rewrite(c.Body).(*ast.BlockStmt)
 		}
 		return &c
 	case *ast.UnaryExpr:
 		c := *v
-		c.X = rewrite(c.X).(ast.Expr)
+		c.X = r.rewrite(c.X).(ast.Expr)
 		return &c
 	case *ast.ValueSpec:
 		c := *v
-		c.Values = rewriteExprs(c.Values)
+		c.Values = r.rewriteExprs(c.Values)
 		return &c
 	}
 }
 
 func Process(source []byte) ([]byte, error) {
+	return ProcessWith(source, Options{})
+}
+
+func ProcessFile(filename string, inplace bool) error {
+	return ProcessFileWith(filename, inplace, Options{})
+}
+
+func ProcessWith(source []byte, opts Options) ([]byte, error) {
+	return processSource("go.go", source, opts)
+}
+
+// Rewrite adds ctx to the function definitions and calls in f, which was
+// parsed with fset, the same way Process does, for callers that already have
+// an AST. f itself isn't modified: the returned file is a copy that shares
+// structure with f wherever nothing changed. Its imports aren't sorted and
+// the added nodes have no positions, so callers printing it should call
+// ast.SortImports first and then gofmt the output, as Process does. If f has
+// syntax errors, Rewrite returns nil.
+func Rewrite(fset *token.FileSet, f *ast.File) *ast.File {
+	rewritten, _ := RewriteWith(fset, f, Options{})
+	return rewritten
+}
+
+// RewriteWith is like Rewrite, but with options. It fails under Strict, or if
+// f contains nodes the parser couldn't make sense of.
+func RewriteWith(fset *token.FileSet, f *ast.File, opts Options) (
+	*ast.File, error) {
+	_, rewritten, err := rewriteFile(fset, f, opts)
+	return rewritten, err
+}
+
+// rewriteFile rewrites f, returning the rewriter as well for the details it
+// collected.
+func rewriteFile(fset *token.FileSet, f *ast.File, opts Options) (
+	*rewriter, *ast.File, error) {
+	if err := CheckOptions(opts); err != nil {
+		return nil, nil, err
+	}
+	// the file's findings are reported only if the rewrite succeeds
+	report := opts.Report
+	if report != nil {
+		opts.Report = &Report{}
+	}
+	r := newRewriter(fset, opts)
+	rewritten := r.rewrite(f).(*ast.File)
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if report != nil {
+		if opts.Validate {
+			for _, problem := range r.inconsistencies(rewritten) {
+				opts.Report.Warnings = append(opts.Report.Warnings,
+					problem.String())
+			}
+		}
+		report.merge(opts.Report)
+	}
+	return r, rewritten, nil
+}
+
+func ProcessFileWith(filename string, inplace bool, opts Options) error {
+	_, data, err := ReadAndProcess(filename, opts)
+	if err != nil {
+		return err
+	}
+	if inplace {
+		return ioutil.WriteFile(filename, data, 0644)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// ReadAndProcess reads and rewrites filename, returning both its original and
+// rewritten contents without writing anything.
+func ReadAndProcess(filename string, opts Options) (
+	original, processed []byte, err error) {
+	original, err = ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.OnlyPackageCalls || opts.BoundaryThread {
+		opts.packageDir = filepath.Dir(filename)
+	}
+	processed, err = processSource(filename, original, opts)
+	return original, processed, err
+}
+
+// processSource rewrites source, using filename for positions.
+func processSource(filename string, source []byte, opts Options) (
+	[]byte, error) {
+	processed, err := rewriteSource(filename, source, opts)
+	if err == nil && opts.Report != nil && bytes.Equal(source, processed) {
+		opts.Report.Unchanged = append(opts.Report.Unchanged, filename)
+	}
+	return processed, err
+}
+
+func rewriteSource(filename string, source []byte, opts Options) (
+	[]byte, error) {
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, "go.go", source, parser.ParseComments)
+	f, err := parser.ParseFile(fset, filename, source, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
-	var out bytes.Buffer
-	err = printer.Fprint(&out, fset, rewrite(f))
-	return out.Bytes(), err
+	if opts.OnlyPackage != "" && f.Name.Name != opts.OnlyPackage {
+		return source, nil
+	}
+	if opts.Tags != nil {
+		ok, err := satisfiesTags(f, opts.Tags)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return source, nil
+		}
+	}
+	return render(fset, f, opts)
 }
 
-func ProcessFile(filename string, inplace bool) error {
-	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+// render rewrites f and prints the result.
+func render(fset *token.FileSet, f *ast.File, opts Options) ([]byte, error) {
+	r, rewritten, err := rewriteFile(fset, f, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	out := os.Stdout
-	if inplace {
-		fh, err := os.Create(filename)
+	return printFile(fset, rewritten, opts, r.rewrittenFuncs)
+}
+
+// printFile prints f, which was parsed with fset and then had ctx added, as
+// opts says to. rewrittenFuncs is the rewriter's record of the functions
+// that gained ctx, for DocumentCtx.
+func printFile(fset *token.FileSet, f *ast.File, opts Options,
+	rewrittenFuncs map[int]string) ([]byte, error) {
+	positionAdded(fset, f)
+	ast.SortImports(fset, f)
+	config := &gofmtConfig
+	if opts.Printer != nil {
+		config = opts.Printer
+	}
+	var out bytes.Buffer
+	err := config.Fprint(&out, fset, f)
+	if err != nil {
+		return nil, err
+	}
+	result := out.Bytes()
+	if opts.Printer == nil {
+		// the nodes added by the rewrite have no positions, so the printer
+		// can't lay them out like gofmt would (e.g. it leaves a trailing
+		// comma after a lone ctx parameter). Reformatting the printed source
+		// fixes that.
+		result, err = format.Source(result)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if opts.MaxLineWidth > 0 {
+		result, err = wrapLines(result, opts.MaxLineWidth, config.Tabwidth)
+		if err != nil {
+			return nil, err
 		}
-		defer fh.Close()
-		out = fh
+		if opts.Printer == nil {
+			result, err = format.Source(result)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.DocumentCtx {
+		result, err = documentCtx(result, rewrittenFuncs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.StampVersion {
+		result, err = stampVersion(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.IndentSpaces > 0 {
+		result = indentWithSpaces(result, opts.IndentSpaces)
 	}
-	return printer.Fprint(out, fset, rewrite(f))
+	return result, nil
 }
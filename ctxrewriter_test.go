@@ -0,0 +1,3388 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// processTests are rewrites of whole files: in, processed with opts, should
+// give out. Both are gofmt-formatted, and a leading newline is dropped so
+// the sources can start on their own line.
+var processTests = []struct {
+	name string
+	opts Options
+	in   string
+	out  string
+}{
+	{
+		name: "stringer and handler keep their signatures",
+		in: `
+package p
+
+import "net/http"
+
+type T struct{}
+
+func (t T) String() string { return t.name() }
+
+func (t T) name() string { return "" }
+
+func (t *T) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(t.String()))
+}
+`,
+		out: `
+package p
+
+import (
+	"context"
+	"net/http"
+)
+
+type T struct{}
+
+func (t T) String() string { return t.name(context.Background()) }
+
+func (t T) name(ctx context.Context) string { return "" }
+
+func (t *T) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(t.String()))
+}
+`,
+	},
+	{
+		name: "calls to a same-named method that isn't exempt gain ctx",
+		in: `
+package p
+
+type Job struct{}
+
+func (j *Job) Close() {}
+
+func (j *Job) Len() string { return "" }
+
+func run(j *Job) {
+	j.Close()
+	_ = j.Len()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type Job struct{}
+
+func (j *Job) Close(ctx context.Context) {}
+
+func (j *Job) Len(ctx context.Context) string { return "" }
+
+func run(ctx context.Context, j *Job) {
+	j.Close(ctx)
+	_ = j.Len(ctx)
+}
+`,
+	},
+	{
+		name: "calls on the receiver follow the receiver's method",
+		in: `
+package p
+
+type File struct{}
+
+func (f *File) Close() error { return nil }
+
+type Job struct{ f *File }
+
+func (j *Job) Close() { j.f.Close() }
+
+func (f *File) Sync() { f.Close() }
+`,
+		out: `
+package p
+
+import "context"
+
+type File struct{}
+
+func (f *File) Close() error { return nil }
+
+type Job struct{ f *File }
+
+func (j *Job) Close(ctx context.Context) { j.f.Close() }
+
+func (f *File) Sync(ctx context.Context) { f.Close() }
+`,
+	},
+	{
+		name: "calls through a local interface follow its signature",
+		in: `
+package p
+
+type Closer interface{ Close() }
+
+func shut(c Closer) { c.Close() }
+`,
+		out: `
+package p
+
+import "context"
+
+type Closer interface{ Close(ctx context.Context) }
+
+func shut(ctx context.Context, c Closer) { c.Close(ctx) }
+`,
+	},
+	{
+		name: "calls through func-typed values keep their arguments",
+		opts: Options{SkipTypeDecls: true},
+		in: `
+package p
+
+type H struct{ fn func(int) }
+
+type Runner interface{ Run(int) }
+
+func work(i int) {}
+
+func call(fn func(int), h H, r Runner) {
+	fn(5)
+	h.fn(1)
+	(func(int))(fn)(5)
+	r.Run(2)
+	g := func(i int) { work(i) }
+	g(3)
+	w := work
+	w(4)
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type H struct{ fn func(int) }
+
+type Runner interface{ Run(int) }
+
+func work(ctx context.Context, i int) {}
+
+func call(ctx context.Context, fn func(int), h H, r Runner) {
+	fn(5)
+	h.fn(1)
+	(func(int))(fn)(5)
+	r.Run(2)
+	g := func(ctx context.Context, i int) { work(ctx, i) }
+	g(ctx, 3)
+	w := work
+	w(ctx, 4)
+}
+`,
+	},
+	{
+		name: "map value func types follow SkipTypeDecls",
+		opts: Options{SkipTypeDecls: true},
+		in: `
+package p
+
+type Registry struct {
+	handlers map[string]func(int)
+}
+
+func work() {}
+
+func run(r *Registry) { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+type Registry struct {
+	handlers map[string]func(int)
+}
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context, r *Registry) { work(ctx) }
+`,
+	},
+	{
+		name: "map value func types and calls through them are left alone",
+		opts: Options{SkipTypeDecls: true},
+		in: `
+package p
+
+type Registry struct {
+	handlers map[string]func(int)
+}
+
+func dispatch(r *Registry, name string) {
+	r.handlers[name](5)
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type Registry struct {
+	handlers map[string]func(int)
+}
+
+func dispatch(ctx context.Context, r *Registry, name string) {
+	r.handlers[name](5)
+}
+`,
+	},
+	{
+		name: "calls through funcs received from a channel are left alone",
+		opts: Options{SkipTypeDecls: true},
+		in: `
+package p
+
+func dispatch(c chan func(int)) {
+	(<-c)(2)
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func dispatch(ctx context.Context, c chan func(int)) {
+	(<-c)(2)
+}
+`,
+	},
+	{
+		name: "literals without ctx use the enclosing function's",
+		opts: Configure(WithDefinitions(false), WithImportPath("context")),
+		in: `
+package p
+
+import "context"
+
+var h = func() { work() }
+
+func init() {
+	go func() { work() }()
+}
+
+func work() {}
+
+func run(ctx context.Context) {
+	func() { work() }()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+var h = func() { work(context.Background()) }
+
+func init() {
+	go func() { work(context.Background()) }()
+}
+
+func work() {}
+
+func run(ctx context.Context) {
+	func() { work(ctx) }()
+}
+`,
+	},
+	{
+		name: "import path and variable name",
+		opts: Configure(WithImportPath("context"), WithVarName("c")),
+		in: `
+package p
+
+func work() {}
+
+func run() { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+func work(c context.Context) {}
+
+func run(c context.Context) { work(c) }
+`,
+	},
+	{
+		name: "the x/net/context import path",
+		opts: Options{ImportPath: "golang.org/x/net/context"},
+		in: `
+package p
+
+func work() {}
+
+func run() { work() }
+`,
+		out: `
+package p
+
+import "golang.org/x/net/context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "definitions only",
+		opts: Configure(WithDefinitions(true), WithCalls(false)),
+		in: `
+package p
+
+func work() {}
+
+func run() { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) { work() }
+`,
+	},
+	{
+		name: "calls out of ctx's scope get the fallback",
+		in: `
+package p
+
+var x = compute()
+
+func init() {
+	work()
+	func() { work() }()
+}
+
+func compute() int { return 0 }
+
+func work() {}
+`,
+		out: `
+package p
+
+import "context"
+
+var x = compute(context.Background())
+
+func init() {
+	work(context.Background())
+	func(ctx context.Context) { work(ctx) }(context.Background())
+}
+
+func compute(ctx context.Context) int { return 0 }
+
+func work(ctx context.Context) {}
+`,
+	},
+	{
+		name: "functions without ctx get the fallback with definitions skipped",
+		opts: Options{SkipDefinitions: true, ImportPath: "context",
+			Fallback: "TODO"},
+		in: `
+package p
+
+import "context"
+
+var x = compute()
+
+func compute() int { return 0 }
+
+func work() {}
+
+func plain() {
+	work()
+	go func() { work() }()
+}
+
+func run(ctx context.Context) { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+var x = compute(context.TODO())
+
+func compute() int { return 0 }
+
+func work() {}
+
+func plain() {
+	work(context.TODO())
+	go func() { work(context.TODO()) }()
+}
+
+func run(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "ctx goes before variadic parameters and spread arguments",
+		opts: Options{ParamIndex: 1},
+		in: `
+package p
+
+type Tx struct{}
+
+func log(tx *Tx, format string, args ...interface{}) {}
+
+func sum(xs ...int) int { return 0 }
+
+func run(tx *Tx, xs []int) {
+	log(tx, "x %d", 1)
+	sum(xs...)
+	sum(1, 2, 3)
+	fetch(tx)
+}
+
+func fetch(tx *Tx) {}
+`,
+		out: `
+package p
+
+import "context"
+
+type Tx struct{}
+
+func log(tx *Tx, ctx context.Context, format string, args ...interface{}) {}
+
+func sum(ctx context.Context, xs ...int) int { return 0 }
+
+func run(tx *Tx, ctx context.Context, xs []int) {
+	log(tx, ctx, "x %d", 1)
+	sum(ctx, xs...)
+	sum(ctx, 1, 2, 3)
+	fetch(tx, ctx)
+}
+
+func fetch(tx *Tx, ctx context.Context) {}
+`,
+	},
+	{
+		name: "ctx parameters are recognized under any context import name",
+		in: `
+package p
+
+import (
+	stdctx "context"
+
+	xctx "golang.org/x/net/context"
+)
+
+func work(ctx stdctx.Context) {}
+
+func fetch(c xctx.Context, id int) { work(c) }
+
+func run(ctx stdctx.Context) { fetch(ctx, 1) }
+`,
+		out: `
+package p
+
+import (
+	stdctx "context"
+
+	xctx "golang.org/x/net/context"
+)
+
+func work(ctx stdctx.Context) {}
+
+func fetch(c xctx.Context, id int) { work(c) }
+
+func run(ctx stdctx.Context) { fetch(ctx, 1) }
+`,
+	},
+	{
+		name: "pointer conversions and unsafe calls don't gain ctx",
+		in: `
+package p
+
+import "unsafe"
+
+type handler func()
+
+func work() {}
+
+func run(p *int, f *handler) {
+	_ = (*int)(unsafe.Pointer(p))
+	_ = (*[]byte)(nil)
+	_ = (*unsafe.Pointer)(nil)
+	_ = unsafe.Sizeof(p)
+	(*f)()
+	work()
+}
+`,
+		out: `
+package p
+
+import (
+	"context"
+	"unsafe"
+)
+
+type handler func(ctx context.Context)
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context, p *int, f *handler) {
+	_ = (*int)(unsafe.Pointer(p))
+	_ = (*[]byte)(nil)
+	_ = (*unsafe.Pointer)(nil)
+	_ = unsafe.Sizeof(p)
+	(*f)(ctx)
+	work(ctx)
+}
+`,
+	},
+	{
+		name: "goroutine closures launched with context.Background()",
+		opts: Options{BackgroundGoroutines: true},
+		in: `
+package p
+
+func work() {}
+
+func run() {
+	go func() { work() }()
+	go func(n int) { work() }(1)
+	go work()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) {
+	go func(ctx context.Context) { work(ctx) }(context.Background())
+	go func(ctx context.Context, n int) { work(ctx) }(context.Background(), 1)
+	go work(ctx)
+}
+`,
+	},
+	{
+		name: "goroutine closures in package-level literals",
+		opts: Options{BackgroundGoroutines: true},
+		in: `
+package p
+
+func work() {}
+
+var _ = func() { go func() { work() }() }
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+var _ = func(ctx context.Context) { go func(ctx context.Context) { work(ctx) }(context.Background()) }
+`,
+	},
+	{
+		name: "x/net/context imports migrate to the standard library",
+		opts: Options{StdlibContext: true},
+		in: `
+package p
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+var _ fmt.Stringer
+
+func work(ctx context.Context) {}
+
+func run() { work() }
+`,
+		out: `
+package p
+
+import (
+	"fmt"
+
+	"context"
+)
+
+var _ fmt.Stringer
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "calls already passing ctx aren't given another",
+		in: `
+package p
+
+import "golang.org/x/net/context"
+
+func f(ctx context.Context, x int) {}
+
+func run(ctx context.Context, x int) {
+	f(ctx, x)
+	f(x)
+}
+`,
+		out: `
+package p
+
+import "golang.org/x/net/context"
+
+func f(ctx context.Context, x int) {}
+
+func run(ctx context.Context, x int) {
+	f(ctx, x)
+	f(ctx, x)
+}
+`,
+	},
+	{
+		name: "build constraints stay above the package clause",
+		in: `
+//go:build (linux && amd64) || darwin
+// +build linux,amd64 darwin
+
+// Package p does things.
+package p
+
+func work() {}
+`,
+		out: `
+//go:build (linux && amd64) || darwin
+// +build linux,amd64 darwin
+
+// Package p does things.
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+`,
+	},
+	{
+		name: "package line comments stay on the package line",
+		in: `
+package p // import "example.com/p"
+
+// work does the work.
+func work() {}
+`,
+		out: `
+package p // import "example.com/p"
+
+import "context"
+
+// work does the work.
+func work(ctx context.Context) {}
+`,
+	},
+	{
+		name: "calls inside index expressions gain ctx",
+		in: `
+package p
+
+func key() string { return "" }
+
+func compute() int { return 0 }
+
+func run(m map[string]int, arr []int) {
+	_ = m[key()]
+	_ = arr[compute()]
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func key(ctx context.Context) string { return "" }
+
+func compute(ctx context.Context) int { return 0 }
+
+func run(ctx context.Context, m map[string]int, arr []int) {
+	_ = m[key(ctx)]
+	_ = arr[compute(ctx)]
+}
+`,
+	},
+	{
+		name: "a receiver named ctx makes the parameter ctx2",
+		in: `
+package p
+
+type T struct{}
+
+func (ctx *T) M() { ctx.n() }
+
+func (t *T) n() {}
+`,
+		out: `
+package p
+
+import "context"
+
+type T struct{}
+
+func (ctx *T) M(ctx2 context.Context) { ctx.n(ctx2) }
+
+func (t *T) n(ctx context.Context) {}
+`,
+	},
+	{
+		name: "calls in nested implicit composite literals",
+		in: `
+package p
+
+type T struct{ n int }
+
+func f() int { return 1 }
+
+func g() [][]T { return [][]T{{{f()}}, {{n: f()}}} }
+`,
+		out: `
+package p
+
+import "context"
+
+type T struct{ n int }
+
+func f(ctx context.Context) int { return 1 }
+
+func g(ctx context.Context) [][]T { return [][]T{{{f(ctx)}}, {{n: f(ctx)}}} }
+`,
+	},
+	{
+		name: "target a single function by line",
+		opts: Options{TargetLines: map[string][]int{"go.go": {5}}},
+		in: `
+package p
+
+func work() {}
+
+func a() { work() }
+
+func b() { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+func work() {}
+
+func a(ctx context.Context) { work(ctx) }
+
+func b() { work() }
+`,
+	},
+	{
+		name: "spread of a call result to a variadic func",
+		in: `
+package p
+
+func collect() []int { return nil }
+
+func process(xs ...int) {}
+
+func run() { process(collect()...) }
+`,
+		out: `
+package p
+
+import "context"
+
+func collect(ctx context.Context) []int { return nil }
+
+func process(ctx context.Context, xs ...int) {}
+
+func run(ctx context.Context) { process(ctx, collect(ctx)...) }
+`,
+	},
+	{
+		name: "methods with generic receivers",
+		in: `
+package p
+
+type Stack[T any] struct{ items []T }
+
+func (s *Stack[T]) Push(x T) { s.grow() }
+
+func (s *Stack[T]) grow() {}
+
+type Pair[K comparable, V any] struct{}
+
+func (p Pair[K, V]) Get(k K) (v V) { return v }
+`,
+		out: `
+package p
+
+import "context"
+
+type Stack[T any] struct{ items []T }
+
+func (s *Stack[T]) Push(ctx context.Context, x T) { s.grow(ctx) }
+
+func (s *Stack[T]) grow(ctx context.Context) {}
+
+type Pair[K comparable, V any] struct{}
+
+func (p Pair[K, V]) Get(ctx context.Context, k K) (v V) { return v }
+`,
+	},
+	{
+		name: "empty function body",
+		in: `
+package p
+
+func noop() {}
+`,
+		out: `
+package p
+
+import "context"
+
+func noop(ctx context.Context) {}
+`,
+	},
+	{
+		name: "skip funcs used as values",
+		opts: Options{SkipFuncValues: true},
+		in: `
+package p
+
+func handler() {}
+
+func work() {}
+
+var h = handler
+
+func run() { work(); handler() }
+`,
+		out: `
+package p
+
+import "context"
+
+func handler() {}
+
+func work(ctx context.Context) {}
+
+var h = handler
+
+func run(ctx context.Context) { work(ctx); handler() }
+`,
+	},
+	{
+		name: "if with an init calling a local func",
+		in: `
+package p
+
+func f() int { return 1 }
+
+func run() {
+	if x := f(); x > 0 {
+		f()
+	}
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func f(ctx context.Context) int { return 1 }
+
+func run(ctx context.Context) {
+	if x := f(ctx); x > 0 {
+		f(ctx)
+	}
+}
+`,
+	},
+	{
+		name: "var name for a mapped package",
+		opts: Options{VarNameByPackage: map[string]string{"server": "sctx"}},
+		in: `
+package server
+
+func work() {}
+
+func run() { work() }
+`,
+		out: `
+package server
+
+import "context"
+
+func work(sctx context.Context) {}
+
+func run(sctx context.Context) { work(sctx) }
+`,
+	},
+	{
+		name: "default var name for an unmapped package",
+		opts: Options{VarNameByPackage: map[string]string{"server": "sctx"}},
+		in: `
+package client
+
+func work() {}
+
+func run() { work() }
+`,
+		out: `
+package client
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "call of a conversion to a func type",
+		in: `
+package p
+
+func run(fn func(int)) { (func(int))(fn)(5) }
+`,
+		out: `
+package p
+
+import "context"
+
+func run(ctx context.Context, fn func(ctx context.Context, _ int)) {
+	(func(ctx context.Context, _ int))(fn)(ctx, 5)
+}
+`,
+	},
+	{
+		name: "merge into a long import block",
+		in: `
+package p
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ = bufio.NewReader
+	_ = bytes.NewReader
+	_ = errors.New
+	_ = io.EOF
+	_ = http.Get
+	_ = os.Exit
+	_ = sort.Ints
+	_ = strconv.Itoa
+	_ = strings.Split
+	_ sync.Mutex
+	_ = time.Now
+)
+
+func work() {}
+
+func run() { work() }
+`,
+		out: `
+package p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ = bufio.NewReader
+	_ = bytes.NewReader
+	_ = errors.New
+	_ = io.EOF
+	_ = http.Get
+	_ = os.Exit
+	_ = sort.Ints
+	_ = strconv.Itoa
+	_ = strings.Split
+	_ sync.Mutex
+	_ = time.Now
+)
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "silence unused ctx only in leaf funcs",
+		opts: Options{SilenceUnused: true},
+		in: `
+package p
+
+func leaf() {}
+
+func run() { leaf() }
+`,
+		out: `
+package p
+
+import "context"
+
+func leaf(ctx context.Context) {
+	_ = ctx
+}
+
+func run(ctx context.Context) { leaf(ctx) }
+`,
+	},
+	{
+		name: "call in a range expression",
+		in: `
+package p
+
+func fetch() map[string]int { return nil }
+
+func run() {
+	for k, v := range fetch() {
+		_, _ = k, v
+	}
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func fetch(ctx context.Context) map[string]int { return nil }
+
+func run(ctx context.Context) {
+	for k, v := range fetch(ctx) {
+		_, _ = k, v
+	}
+}
+`,
+	},
+	{
+		name: "leaf funcs keep their signatures and calls",
+		opts: Options{LeafFuncs: []string{"square"}},
+		in: `
+package p
+
+func square(x int) int { return x * x }
+
+func work() {}
+
+func run() int { work(); return square(2) }
+`,
+		out: `
+package p
+
+import "context"
+
+func square(x int) int { return x * x }
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) int { work(ctx); return square(2) }
+`,
+	},
+	{
+		name: "send on a channel returned by a call",
+		in: `
+package p
+
+func produceCh() chan int { return nil }
+
+func run(x int) { produceCh() <- x }
+`,
+		out: `
+package p
+
+import "context"
+
+func produceCh(ctx context.Context) chan int { return nil }
+
+func run(ctx context.Context, x int) { produceCh(ctx) <- x }
+`,
+	},
+	{
+		name: "builtin call with a call argument",
+		in: `
+package p
+
+func keyFn() string { return "" }
+
+func run(m map[string]int) { delete(m, keyFn()) }
+`,
+		out: `
+package p
+
+import "context"
+
+func keyFn(ctx context.Context) string { return "" }
+
+func run(ctx context.Context, m map[string]int) { delete(m, keyFn(ctx)) }
+`,
+	},
+	{
+		name: "call in a for condition",
+		in: `
+package p
+
+func running() bool { return false }
+
+func run() {
+	for running() {
+	}
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func running(ctx context.Context) bool { return false }
+
+func run(ctx context.Context) {
+	for running(ctx) {
+	}
+}
+`,
+	},
+	{
+		name: "call in the args of a deferred call",
+		in: `
+package p
+
+func compute() int { return 1 }
+
+func report(n int) {}
+
+func run() { defer report(compute()) }
+`,
+		out: `
+package p
+
+import "context"
+
+func compute(ctx context.Context) int { return 1 }
+
+func report(ctx context.Context, n int) {}
+
+func run(ctx context.Context) { defer report(ctx, compute(ctx)) }
+`,
+	},
+	{
+		name: "indent with spaces",
+		opts: Options{IndentSpaces: 4},
+		in: `
+package p
+
+func work() {}
+
+func run() {
+	if true {
+		work()
+	}
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) {
+    if true {
+        work(ctx)
+    }
+}
+`,
+	},
+	{
+		name: "recursive func",
+		in: `
+package p
+
+func fact(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n * fact(n-1)
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func fact(ctx context.Context, n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n * fact(ctx, n-1)
+}
+`,
+	},
+	{
+		name: "custom printer config",
+		opts: Options{Printer: &printer.Config{
+			Mode: printer.UseSpaces, Tabwidth: 2}},
+		in: `
+package p
+
+type T struct {
+	a    int
+	bcde int
+}
+
+func work() {}
+
+func run() {
+	work()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type T struct {
+  a    int
+  bcde int
+}
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) {
+  work(ctx)
+}
+`,
+	},
+	{
+		name: "func literal as a struct field value",
+		in: `
+package p
+
+type Handler struct{ fn func() }
+
+func g() {}
+
+var h = Handler{fn: func() { g() }}
+`,
+		out: `
+package p
+
+import "context"
+
+type Handler struct{ fn func(ctx context.Context) }
+
+func g(ctx context.Context) {}
+
+var h = Handler{fn: func(ctx context.Context) { g(ctx) }}
+`,
+	},
+	{
+		name: "only calls to the named funcs",
+		opts: Options{OnlyCallsTo: []string{"Fetch"}},
+		in: `
+package p
+
+func Fetch() string { return "" }
+
+func Parse(s string) int { return 0 }
+
+func run() int { return Parse(Fetch()) }
+`,
+		out: `
+package p
+
+import "context"
+
+func Fetch(ctx context.Context) string { return "" }
+
+func Parse(ctx context.Context, s string) int { return 0 }
+
+func run(ctx context.Context) int { return Parse(Fetch(ctx)) }
+`,
+	},
+	{
+		name: "calls into the module's own packages",
+		opts: Options{ModulePath: "example.com/app"},
+		in: `
+package p
+
+import (
+	"example.com/app/internal/db"
+	"example.com/app/store"
+	"github.com/other/lib"
+)
+
+func run() {
+	db.Query()
+	store.Get()
+	lib.Do()
+}
+`,
+		out: `
+package p
+
+import (
+	"context"
+	"example.com/app/internal/db"
+	"example.com/app/store"
+	"github.com/other/lib"
+)
+
+func run(ctx context.Context) {
+	db.Query(ctx)
+	store.Get(ctx)
+	lib.Do()
+}
+`,
+	},
+	{
+		name: "calls under unary operators",
+		in: `
+package p
+
+func check() bool { return true }
+
+func compute() int { return 1 }
+
+func run() (bool, int) { return !check(), -compute() }
+`,
+		out: `
+package p
+
+import "context"
+
+func check(ctx context.Context) bool { return true }
+
+func compute(ctx context.Context) int { return 1 }
+
+func run(ctx context.Context) (bool, int) { return !check(ctx), -compute(ctx) }
+`,
+	},
+	{
+		name: "func literal passed to append",
+		in: `
+package p
+
+func g() {}
+
+func run(s []func()) []func() { return append(s, func() { g() }) }
+`,
+		out: `
+package p
+
+import "context"
+
+func g(ctx context.Context) {}
+
+func run(ctx context.Context, s []func(ctx context.Context)) []func(ctx context.Context) {
+	return append(s, func(ctx context.Context) { g(ctx) })
+}
+`,
+	},
+	{
+		name: "method calls on type assertions",
+		in: `
+package p
+
+type TCPConn struct{}
+
+func (c *TCPConn) SetDeadline(n int) {}
+
+func get() interface{} { return nil }
+
+func run(conn interface{}) {
+	conn.(*TCPConn).SetDeadline(0)
+	get().(*TCPConn).SetDeadline(1)
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type TCPConn struct{}
+
+func (c *TCPConn) SetDeadline(ctx context.Context, n int) {}
+
+func get(ctx context.Context) interface{} { return nil }
+
+func run(ctx context.Context, conn interface{}) {
+	conn.(*TCPConn).SetDeadline(ctx, 0)
+	get(ctx).(*TCPConn).SetDeadline(ctx, 1)
+}
+`,
+	},
+	{
+		name: "an existing standard context import is reused",
+		in: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run() { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "an existing x/net/context import is reused",
+		in: `
+package p
+
+import "golang.org/x/net/context"
+
+func run() { run() }
+`,
+		out: `
+package p
+
+import "golang.org/x/net/context"
+
+func run(ctx context.Context) { run(ctx) }
+`,
+	},
+	{
+		name: "an aliased context import is reused",
+		in: `
+package p
+
+import ctxpkg "context"
+
+var _ ctxpkg.Context
+
+func run() { run() }
+`,
+		out: `
+package p
+
+import ctxpkg "context"
+
+var _ ctxpkg.Context
+
+func run(ctx ctxpkg.Context) { run(ctx) }
+`,
+	},
+	{
+		name: "files with only types and consts are unchanged",
+		in: `
+package p
+
+type T int
+
+const (
+	A T = iota
+	B
+)
+`,
+		out: `
+package p
+
+type T int
+
+const (
+	A T = iota
+	B
+)
+`,
+	},
+	{
+		name: "method call on an index expression",
+		in: `
+package p
+
+type entry struct{}
+
+func (e *entry) Refresh() {}
+
+func compute() string { return "" }
+
+func run(cache map[string]*entry) { cache[compute()].Refresh() }
+`,
+		out: `
+package p
+
+import "context"
+
+type entry struct{}
+
+func (e *entry) Refresh(ctx context.Context) {}
+
+func compute(ctx context.Context) string { return "" }
+
+func run(ctx context.Context, cache map[string]*entry) { cache[compute(ctx)].Refresh(ctx) }
+`,
+	},
+	{
+		name: "builtin calls don't gain ctx",
+		in: `
+package p
+
+func work() int { return 0 }
+
+func run(n int) []int {
+	s := make([]int, n)
+	return append(s, work())
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) int { return 0 }
+
+func run(ctx context.Context, n int) []int {
+	s := make([]int, n)
+	return append(s, work(ctx))
+}
+`,
+	},
+	{
+		name: "a local func shadowing a builtin gains ctx",
+		in: `
+package p
+
+func append(s []int, x int) []int { return s }
+
+func run(s []int) []int { return append(s, 1) }
+`,
+		out: `
+package p
+
+import "context"
+
+func append(ctx context.Context, s []int, x int) []int { return s }
+
+func run(ctx context.Context, s []int) []int { return append(ctx, s, 1) }
+`,
+	},
+	{
+		name: "three values unpacked from one call",
+		in: `
+package p
+
+func unpack() (int, int, int) { return 1, 2, 3 }
+
+func run() int {
+	a, b, c := unpack()
+	return a + b + c
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func unpack(ctx context.Context) (int, int, int) { return 1, 2, 3 }
+
+func run(ctx context.Context) int {
+	a, b, c := unpack(ctx)
+	return a + b + c
+}
+`,
+	},
+	{
+		name: "mis-indented source comes out gofmt'd",
+		opts: Options{DenyPackages: []string{"strings"}},
+		in: `
+package p
+
+import "strings"
+
+// work works.
+func work( ) {}
+
+func run() {
+        work() // call
+  var x = strings.ToUpper
+ _ = x
+}
+`,
+		out: `
+package p
+
+import (
+	"context"
+	"strings"
+)
+
+// work works.
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) {
+	work(ctx) // call
+	var x = strings.ToUpper
+	_ = x
+}
+`,
+	},
+	{
+		name: "goroutine closures get the outer ctx",
+		in: `
+package p
+
+func work() {}
+
+func run() {
+	go func() {
+		work()
+	}()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) {
+	go func(ctx context.Context) {
+		work(ctx)
+	}(ctx)
+}
+`,
+	},
+	{
+		name: "calls in keyed slice elements",
+		in: `
+package p
+
+func f() int { return 1 }
+
+func g() int { return 2 }
+
+func run() []int { return []int{0: f(), 2: g()} }
+`,
+		out: `
+package p
+
+import "context"
+
+func f(ctx context.Context) int { return 1 }
+
+func g(ctx context.Context) int { return 2 }
+
+func run(ctx context.Context) []int { return []int{0: f(ctx), 2: g(ctx)} }
+`,
+	},
+	{
+		name: "exported funcs and their internal callees thread ctx",
+		opts: Options{BoundaryThread: true},
+		in: `
+package p
+
+type Client struct{}
+
+func (c *Client) Fetch(id int) string { return c.lookup(id) }
+
+func (c *Client) lookup(id int) string { return format(id) }
+
+func (c *Client) reset() { drop() }
+
+func Fetch(id int) string { return new(Client).Fetch(id) }
+
+func format(id int) string { return "" }
+
+func drop() {}
+
+func init() { new(Client).reset() }
+`,
+		out: `
+package p
+
+import "context"
+
+type Client struct{}
+
+func (c *Client) Fetch(ctx context.Context, id int) string { return c.lookup(ctx, id) }
+
+func (c *Client) lookup(ctx context.Context, id int) string { return format(ctx, id) }
+
+func (c *Client) reset() { drop() }
+
+func Fetch(ctx context.Context, id int) string { return new(Client).Fetch(ctx, id) }
+
+func format(ctx context.Context, id int) string { return "" }
+
+func drop() {}
+
+func init() { new(Client).reset() }
+`,
+	},
+	{
+		name: "deferred method call on a call result",
+		in: `
+package p
+
+type closer struct{}
+
+func (c closer) done() {}
+
+func open() int { return 0 }
+
+func mustClose(fd int) closer { return closer{} }
+
+func run() {
+	defer mustClose(open()).done()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type closer struct{}
+
+func (c closer) done(ctx context.Context) {}
+
+func open(ctx context.Context) int { return 0 }
+
+func mustClose(ctx context.Context, fd int) closer { return closer{} }
+
+func run(ctx context.Context) {
+	defer mustClose(ctx, open(ctx)).done(ctx)
+}
+`,
+	},
+	{
+		name: "calls inside a fenced region are unchanged",
+		in: `
+package p
+
+func work() {}
+
+func run() {
+	work()
+	// ctxrewriter:off
+	work()
+	// ctxrewriter:on
+	work()
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func run(ctx context.Context) {
+	work(ctx)
+	// ctxrewriter:off
+	work()
+	// ctxrewriter:on
+	work(ctx)
+}
+`,
+	},
+	{
+		name: "calls to fenced functions and methods are unchanged",
+		in: `
+package p
+
+type Cache struct{}
+
+// ctxrewriter:off
+func (c *Cache) Get(key string) string { return "" }
+
+func lookup(key string) string { return "" }
+
+// ctxrewriter:on
+
+func (c *Cache) Warm(key string) { c.Get(key) }
+
+func run(c *Cache) string { return c.Get("k") + lookup("k") }
+`,
+		out: `
+package p
+
+import "context"
+
+type Cache struct{}
+
+// ctxrewriter:off
+func (c *Cache) Get(key string) string { return "" }
+
+func lookup(key string) string { return "" }
+
+// ctxrewriter:on
+
+func (c *Cache) Warm(ctx context.Context, key string) { c.Get(key) }
+
+func run(ctx context.Context, c *Cache) string { return c.Get("k") + lookup("k") }
+`,
+	},
+	{
+		name: "exempt method called through an embedded interface",
+		in: `
+package p
+
+type Closer interface{ Close() error }
+
+type Store interface {
+	Closer
+	Get(key string) string
+}
+
+func run(s Store) {
+	s.Close()
+	s.Get("k")
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type Closer interface{ Close() error }
+
+type Store interface {
+	Closer
+	Get(ctx context.Context, key string) string
+}
+
+func run(ctx context.Context, s Store) {
+	s.Close()
+	s.Get(ctx, "k")
+}
+`,
+	},
+	{
+		name: "method called through an embedded interface with nothing exempt",
+		opts: Options{ExemptMethods: []string{}},
+		in: `
+package p
+
+type Closer interface{ Close() error }
+
+type Store interface {
+	Closer
+	Get(key string) string
+}
+
+func run(s Store) {
+	s.Close()
+	s.Get("k")
+}
+`,
+		out: `
+package p
+
+import "context"
+
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+type Store interface {
+	Closer
+	Get(ctx context.Context, key string) string
+}
+
+func run(ctx context.Context, s Store) {
+	s.Close(ctx)
+	s.Get(ctx, "k")
+}
+`,
+	},
+	{
+		name: "conversion of a call result",
+		in: `
+package p
+
+func compute() int64 { return 1 }
+
+func run() int { return int(compute()) }
+`,
+		out: `
+package p
+
+import "context"
+
+func compute(ctx context.Context) int64 { return 1 }
+
+func run(ctx context.Context) int { return int(compute(ctx)) }
+`,
+	},
+	{
+		name: "body that is a labeled statement",
+		in: `
+package p
+
+func done() bool { return true }
+
+func f() {
+Loop:
+	for {
+		if done() {
+			break Loop
+		}
+	}
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func done(ctx context.Context) bool { return true }
+
+func f(ctx context.Context) {
+Loop:
+	for {
+		if done(ctx) {
+			break Loop
+		}
+	}
+}
+`,
+	},
+	{
+		name: "generic funcs and instantiations",
+		in: `
+package p
+
+func Foo[K comparable, V any](k K, v V) {}
+
+func Bar[T any](t T) {}
+
+func run(a string) {
+	Foo[int, string](1, a)
+	Bar[int](2)
+	Bar(a)
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func Foo[K comparable, V any](ctx context.Context, k K, v V) {}
+
+func Bar[T any](ctx context.Context, t T) {}
+
+func run(ctx context.Context, a string) {
+	Foo[int, string](ctx, 1, a)
+	Bar[int](ctx, 2)
+	Bar(ctx, a)
+}
+`,
+	},
+	{
+		name: "return of several calls",
+		in: `
+package p
+
+func f() int { return 1 }
+
+func g() error { return nil }
+
+func run() (int, error) { return f(), g() }
+`,
+		out: `
+package p
+
+import "context"
+
+func f(ctx context.Context) int { return 1 }
+
+func g(ctx context.Context) error { return nil }
+
+func run(ctx context.Context) (int, error) { return f(ctx), g(ctx) }
+`,
+	},
+	{
+		name: "call in a switch init",
+		in: `
+package p
+
+const A = 1
+
+func classify(x int) int { return x }
+
+func run(x int) {
+	switch v := classify(x); v {
+	case A:
+	}
+}
+`,
+		out: `
+package p
+
+import "context"
+
+const A = 1
+
+func classify(ctx context.Context, x int) int { return x }
+
+func run(ctx context.Context, x int) {
+	switch v := classify(ctx, x); v {
+	case A:
+	}
+}
+`,
+	},
+	{
+		name: "doc and inline comments stay in place",
+		in: `
+// Package p does things.
+package p
+
+// work does the work.
+func work( /* nothing yet */ ) {}
+
+// run runs.
+//
+// It calls work.
+func run() {
+	// first, the work
+	work() // inline
+	/* done */
+}
+
+// T is a type.
+type T struct{}
+
+// M is a method.
+func (t *T) M() {
+	// comment before the call
+	work()
+}
+`,
+		out: `
+// Package p does things.
+package p
+
+import "context"
+
+// work does the work.
+func work( /* nothing yet */ ctx context.Context) {}
+
+// run runs.
+//
+// It calls work.
+func run(ctx context.Context) {
+	// first, the work
+	work(ctx) // inline
+	/* done */
+}
+
+// T is a type.
+type T struct{}
+
+// M is a method.
+func (t *T) M(ctx context.Context) {
+	// comment before the call
+	work(ctx)
+}
+`,
+	},
+	{
+		name: "main and init keep their signatures",
+		in: `
+package main
+
+func work() {}
+
+func init() { work() }
+
+func main() { work() }
+`,
+		out: `
+package main
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func init() { work(context.Background()) }
+
+func main() { work(context.Background()) }
+`,
+	},
+	{
+		name: "main outside package main is an ordinary func",
+		in: `
+package p
+
+func work() {}
+
+func init() { work() }
+
+func main() { work() }
+`,
+		out: `
+package p
+
+import "context"
+
+func work(ctx context.Context) {}
+
+func init() { work(context.Background()) }
+
+func main(ctx context.Context) { work(ctx) }
+`,
+	},
+	{
+		name: "long argument lists wrap at the max line width",
+		opts: Options{MaxLineWidth: 80},
+		in: `
+package p
+
+func configure(name string, retries int, timeout int, verbose bool, tags []string) {}
+
+func run() {
+	configure("a-rather-long-service-name", 3, 30, true, []string{"alpha", "beta"})
+}
+`,
+		out: `
+package p
+
+import "context"
+
+func configure(ctx context.Context, name string, retries int, timeout int,
+	verbose bool, tags []string) {
+}
+
+func run(ctx context.Context) {
+	configure(ctx, "a-rather-long-service-name", 3, 30, true,
+		[]string{"alpha", "beta"})
+}
+`,
+	},
+	{
+		name: "calls on both sides of an index assignment",
+		in: `
+package p
+
+func key() string { return "" }
+
+func value() int { return 0 }
+
+func run(m map[string]int) { m[key()] = value() }
+`,
+		out: `
+package p
+
+import "context"
+
+func key(ctx context.Context) string { return "" }
+
+func value(ctx context.Context) int { return 0 }
+
+func run(ctx context.Context, m map[string]int) { m[key(ctx)] = value(ctx) }
+`,
+	},
+	{
+		name: "allow and deny packages for calls",
+		opts: Options{AllowPackages: []string{"myorg/..."},
+			DenyPackages: []string{"myorg/db/internal/..."}},
+		in: `
+package p
+
+import (
+	"fmt"
+	"myorg/db"
+	"myorg/db/internal/cache"
+	"strings"
+)
+
+func helper() string { return "" }
+
+func run() {
+	fmt.Println(helper())
+	db.Query(strings.ToUpper("x"))
+	cache.Get()
+}
+`,
+		out: `
+package p
+
+import (
+	"context"
+	"fmt"
+	"myorg/db"
+	"myorg/db/internal/cache"
+	"strings"
+)
+
+func helper(ctx context.Context) string { return "" }
+
+func run(ctx context.Context) {
+	fmt.Println(helper(ctx))
+	db.Query(ctx, strings.ToUpper("x"))
+	cache.Get()
+}
+`,
+	},
+	{
+		name: "composite literal as a call argument",
+		in: `
+package p
+
+type Config struct{ Retries int }
+
+func computeRetries() int { return 3 }
+
+func process(c Config) {}
+
+func run() { process(Config{Retries: computeRetries()}) }
+`,
+		out: `
+package p
+
+import "context"
+
+type Config struct{ Retries int }
+
+func computeRetries(ctx context.Context) int { return 3 }
+
+func process(ctx context.Context, c Config) {}
+
+func run(ctx context.Context) { process(ctx, Config{Retries: computeRetries(ctx)}) }
+`,
+	},
+	{
+		name: "only calls to the package's own funcs",
+		opts: Options{OnlyPackageCalls: true},
+		in: `
+package p
+
+import "strings"
+
+func helper() string { return "" }
+
+func run() string {
+	transform := strings.ToUpper
+	return transform(strings.ToUpper(helper()))
+}
+`,
+		out: `
+package p
+
+import (
+	"context"
+	"strings"
+)
+
+func helper(ctx context.Context) string { return "" }
+
+func run(ctx context.Context) string {
+	transform := strings.ToUpper
+	return transform(strings.ToUpper(helper(ctx)))
+}
+`,
+	},
+}
+
+func TestProcess(t *testing.T) {
+	for _, test := range processTests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ProcessWith([]byte(trimSource(test.in)), test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := trimSource(test.out); string(got) != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func trimSource(source string) string {
+	return strings.TrimPrefix(source, "\n")
+}
+
+func TestProcessIdempotent(t *testing.T) {
+	for _, test := range processTests {
+		if test.opts.TargetLines != nil {
+			// the added import moves the targeted lines
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			want := trimSource(test.out)
+			got, err := ProcessWith([]byte(want), test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("a second run changed:\n%s\nto:\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestProcessGofmtStable(t *testing.T) {
+	for _, test := range processTests {
+		if test.opts.IndentSpaces != 0 || test.opts.Printer != nil {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			want := trimSource(test.out)
+			got, err := format.Source([]byte(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("gofmt changed:\n%s\nto:\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	source := "package p\n\nfunc work() {}\n\nfunc run() { work() }\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := Rewrite(fset, f)
+	ast.SortImports(fset, rewritten)
+	var out bytes.Buffer
+	if err := format.Node(&out, fset, rewritten); err != nil {
+		t.Fatal(err)
+	}
+	got, err := format.Source(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nimport \"context\"\n\n" +
+		"func work(ctx context.Context) {}\n\n" +
+		"func run(ctx context.Context) { work(ctx) }\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	out.Reset()
+	if err := format.Node(&out, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != source {
+		t.Errorf("the input was modified:\n%s", out.Bytes())
+	}
+}
+
+func TestBadNodes(t *testing.T) {
+	source := "package p\n\nfunc work() {}\n\nfunc run() { work(; }\n"
+	_, err := ProcessWith([]byte(source), Options{})
+	want := "go.go:5:19: expected operand, found ';'"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+
+	// the parser still returns what it made of the file, Bad nodes and all
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, "p.go", source, parser.ParseComments)
+	if f == nil {
+		t.Fatal("no partial file")
+	}
+	rewritten, err := RewriteWith(fset, f, Options{})
+	if err == nil || !strings.HasSuffix(err.Error(), ": syntax error") ||
+		rewritten != nil {
+		t.Errorf("got %v and %v, want a syntax error", rewritten, err)
+	}
+	if Rewrite(fset, f) != nil {
+		t.Error("Rewrite returned a file for a partial AST")
+	}
+}
+
+func TestAddedImportSpec(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go",
+		"package p\n\nfunc work() {}\n", parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := Rewrite(fset, f)
+	gen, ok := rewritten.Decls[0].(*ast.GenDecl)
+	if !ok || gen.Tok != token.IMPORT || len(gen.Specs) != 1 {
+		t.Fatalf("no import added: %#v", rewritten.Decls[0])
+	}
+	path := gen.Specs[0].(*ast.ImportSpec).Path
+	if path.Kind != token.STRING || path.Value != `"context"` {
+		t.Errorf("got import path %s %s", path.Kind, path.Value)
+	}
+
+	var out bytes.Buffer
+	if err := format.Node(&out, fset, rewritten); err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := parser.ParseFile(token.NewFileSet(), "p.go", out.Bytes(),
+		parser.ImportsOnly)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out.Bytes())
+	}
+	if len(reparsed.Imports) != 1 ||
+		reparsed.Imports[0].Path.Value != path.Value {
+		t.Errorf("import didn't round-trip:\n%s", out.Bytes())
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	original := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	processed := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	want := `--- f.go
++++ f.go
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if got := string(UnifiedDiff("f.go", []byte(original),
+		[]byte(processed))); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	same := UnifiedDiff("f.go", []byte(original), []byte(original))
+	if same != nil {
+		t.Errorf("got %q for no changes", same)
+	}
+}
+
+func TestHTMLDiff(t *testing.T) {
+	got, err := HTMLDiff("a.go", []byte("a\nx < y\nc\n"),
+		[]byte("a\nx > y\nc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<div class="filename">a.go</div>`,
+		`<tr class=""><td class="line">1</td><td class="line">1</td>` +
+			`<td class="marker"></td><td><pre>a</pre></td></tr>`,
+		`<tr class="del"><td class="line">2</td><td class="line"></td>` +
+			`<td class="marker">-</td><td><pre>x &lt; y</pre></td></tr>`,
+		`<tr class="ins"><td class="line"></td><td class="line">2</td>` +
+			`<td class="marker">&#43;</td><td><pre>x &gt; y</pre></td></tr>`,
+		`<tr class=""><td class="line">3</td><td class="line">3</td>` +
+			`<td class="marker"></td><td><pre>c</pre></td></tr>`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("missing %s in:\n%s", want, got)
+		}
+	}
+}
+
+func TestHTMLDiffHighlighting(t *testing.T) {
+	got, err := HTMLDiff("a.go", []byte("func f() {\n\tx := `a\nb` // c\n}\n"),
+		[]byte("func f() {\n\tx := `a\nb` /* c */ + 1\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<pre><span class="keyword">func</span> f() {</pre>`,
+		"<pre>\tx := <span class=\"string\">`a</span></pre>",
+		"<pre><span class=\"string\">b`</span> " +
+			`<span class="comment">// c</span></pre>`,
+		"<pre><span class=\"string\">b`</span> " +
+			`<span class="comment">/* c */</span> + ` +
+			`<span class="number">1</span></pre>`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("missing %s in:\n%s", want, got)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, test := range []struct{ a, b string }{
+		{"", "x y"},
+		{"x y", ""},
+		{"a b c a b b a", "c b a b a c"},
+		{"a b c d", "a x c y"},
+		{"x a b c", "a b c x"},
+	} {
+		a, b := strings.Fields(test.a), strings.Fields(test.b)
+		lines := diffLines(a, b)
+		var gotA, gotB []string
+		equal := 0
+		for i, line := range lines {
+			if line.Op != diffInsert {
+				gotA = append(gotA, line.Text)
+			}
+			if line.Op != diffDelete {
+				gotB = append(gotB, line.Text)
+			}
+			if line.Op == diffEqual {
+				equal++
+			}
+			if i > 0 && line.Op == diffDelete &&
+				lines[i-1].Op == diffInsert {
+				t.Errorf("%q to %q: insertion before deletion", a, b)
+			}
+		}
+		if fmt.Sprint(gotA) != fmt.Sprint(a) ||
+			fmt.Sprint(gotB) != fmt.Sprint(b) {
+			t.Errorf("%q to %q: diff gives %q to %q", a, b, gotA, gotB)
+		}
+		if want := lcsLength(a, b); equal != want {
+			t.Errorf("%q to %q: %d unchanged lines, want %d", a, b, equal,
+				want)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	// too big for a table of every pair of lines
+	var a, b []string
+	for i := 0; i < 50000; i++ {
+		a = append(a, fmt.Sprint(i))
+		b = append(b, fmt.Sprint(i))
+	}
+	b[10] = "changed"
+	b[40000] = "changed"
+	changed := 0
+	for _, line := range diffLines(a, b) {
+		if line.Op != diffEqual {
+			changed++
+		}
+	}
+	if changed != 4 {
+		t.Errorf("got %d changed lines, want 4", changed)
+	}
+}
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+// The build errors in these tests are go build's own output for their
+// sources.
+func TestProcessErrors(t *testing.T) {
+	source := `package p
+
+import "context"
+
+func work(c context.Context) {}
+
+func old() {}
+
+func wrap(c context.Context) context.Context { return c }
+
+func pair(a, b context.Context) {}
+
+func run(c context.Context) {
+	work()
+	old(c)
+	pair(wrap(c))
+}
+`
+	errs := ParseBuildErrors([]byte(`# p
+./p.go:14:2: not enough arguments in call to work
+	have ()
+	want (context.Context)
+./p.go:15:6: too many arguments in call to old
+	have (context.Context)
+	want ()
+./p.go:16:7: not enough arguments in call to pair
+	have (context.Context)
+	want (context.Context, context.Context)
+./p.go:17:1: undefined: something
+`))
+	if len(errs) != 3 {
+		t.Fatalf("got %d errors, want 3", len(errs))
+	}
+	got, err := processErrors("p.go", []byte(source), errs,
+		Options{VarName: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package p
+
+import "context"
+
+func work(c context.Context) {}
+
+func old() {}
+
+func wrap(c context.Context) context.Context { return c }
+
+func pair(a, b context.Context) {}
+
+func run(c context.Context) {
+	work(c)
+	old()
+	pair(c, wrap(c))
+}
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// new calls to context.Background() need the import
+	source = "package p\n\nfunc init() { work() }\n"
+	got, err = processErrors("p.go", []byte(source),
+		ParseBuildErrors([]byte(
+			"./p.go:3:15: not enough arguments in call to work\n")),
+		Options{ImportPath: "context"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "package p\n\nimport \"context\"\n\n" +
+		"func init() { work(context.Background()) }\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestProcessErrorsPrunesImports(t *testing.T) {
+	source := "package p\n\nimport \"context\"\n\nfunc work() {}\n\n" +
+		"func init() { work(context.Background()) }\n"
+	errs := ParseBuildErrors([]byte(
+		"./p.go:7:20: too many arguments in call to work\n"))
+	got, err := processErrors("p.go", []byte(source), errs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nfunc work() {}\n\nfunc init() { work() }\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got, err = processErrors("p.go", []byte(source), errs,
+		Options{KeepUnusedImports: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "package p\n\nimport \"context\"\n\nfunc work() {}\n\n" +
+		"func init() { work() }\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	_, err := ProcessWith([]byte(`package p
+
+import "strings"
+
+func run() { strings.ToUpper("") }
+`), Options{Strict: true})
+	want := "go.go:5:14: cannot classify call to strings.ToUpper"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+
+	_, err = ProcessWith([]byte(
+		"package p\n\nfunc run(x interface{ M() }) { x.M() }\n"),
+		Options{Strict: true})
+	want = "go.go:3:32: cannot classify call to x.M"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+
+	got, err := ProcessWith([]byte(
+		"package p\n\nfunc work() {}\n\nfunc run() { work() }\n"),
+		Options{Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "work(ctx)") {
+		t.Errorf("local call wasn't rewritten:\n%s", got)
+	}
+}
+
+func TestModulePath(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "internal", "db")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "go.mod"),
+		[]byte("module example.com/app\n\ngo 1.22\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := ModulePath(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "example.com/app" {
+		t.Errorf("got %q, want %q", path, "example.com/app")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package p
+
+func work() {}
+
+func old() {}
+
+func run() { work() }
+
+func other() { work(); old() }
+`), Options{TargetLines: map[string][]int{"go.go": {3, 7}},
+		Validate: true, Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"go.go:9:16: work takes ctx now, but this call doesn't pass it",
+	}
+	if strings.Join(report.Warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", report.Warnings, want)
+	}
+}
+
+func TestInvalidVarName(t *testing.T) {
+	source := []byte("package p\n\nfunc work() {}\n")
+	for _, name := range []string{"_", "1ctx", "c-tx", "func"} {
+		_, err := ProcessWith(source, Options{VarName: name})
+		want := fmt.Sprintf("invalid ctx variable name %q", name)
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: got %v, want %q", name, err, want)
+		}
+	}
+	_, err := ProcessWith(source,
+		Options{VarNameByPackage: map[string]string{"p": "a b"}})
+	if err == nil {
+		t.Error("expected an error for an invalid per-package name")
+	}
+}
+
+func TestOnlyPackageCallsSiblings(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package p\n\nfunc run() { other(); missing() }\n",
+		"b.go": "package p\n\nfunc other() {}\n",
+	}
+	for name, source := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source),
+			0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, got, err := ReadAndProcess(filepath.Join(dir, "a.go"),
+		Options{OnlyPackageCalls: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nimport \"context\"\n\n" +
+		"func run(ctx context.Context) { other(ctx); missing() }\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBoundaryThreadSiblings(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package p\n\nfunc fetch() {}\n\nfunc unused() {}\n",
+		"b.go": "package p\n\nfunc Fetch() { fetch() }\n",
+	}
+	for name, source := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source),
+			0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, got, err := ReadAndProcess(filepath.Join(dir, "a.go"),
+		Options{BoundaryThread: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nimport \"context\"\n\n" +
+		"func fetch(ctx context.Context) {}\n\nfunc unused() {}\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("CTXREWRITER_VAR", "c")
+	t.Setenv("CTXREWRITER_IMPORT", "golang.org/x/net/context")
+	t.Setenv("CTXREWRITER_STRICT", "true")
+	t.Setenv("CTXREWRITER_PARAM_INDEX", "1")
+	t.Setenv("CTXREWRITER_EXEMPT_METHODS", "Len() int;Swap(int, int)")
+	opts, err := OptionsFromEnv(Options{ImportPath: "example.com/context"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Options{VarName: "c", ImportPath: "example.com/context",
+		Strict: true, ParamIndex: 1,
+		ExemptMethods: []string{"Len() int", "Swap(int, int)"}}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %+v, want %+v", opts, want)
+	}
+
+	t.Setenv("CTXREWRITER_STRICT", "maybe")
+	_, err = OptionsFromEnv(Options{})
+	if err == nil || !strings.HasPrefix(err.Error(), "CTXREWRITER_STRICT: ") {
+		t.Errorf("got %v for a bad value", err)
+	}
+}
+
+func TestReportFailedFile(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package p
+
+import "strings"
+
+func work() {}
+
+func run() { work(); strings.ToUpper("") }
+`), Options{Strict: true, Report: report})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(report.Funcs) != 0 || len(report.Signatures) != 0 ||
+		len(report.ImportAdded) != 0 {
+		t.Errorf("failed file was reported: %+v", report)
+	}
+
+	_, err = ProcessWith([]byte("package p\n\nfunc work() {}\n"),
+		Options{Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Funcs) != 1 || report.Funcs[0].Name != "work" ||
+		report.Signatures["p.work"].New != "work(ctx context.Context)" {
+		t.Errorf("got %+v", report)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	source := []byte(`package p
+
+import "strings"
+
+func work() {}
+
+func run() {
+	work()
+	strings.ToUpper("")
+}
+`)
+	problems, err := Analyze(source,
+		Options{TargetLines: map[string][]int{"go.go": {5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.String())
+	}
+	want := []string{
+		"go.go:8:2: work takes ctx now, but this call doesn't pass it",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	problems, err = Analyze(source, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, problem := range problems {
+		got = append(got, problem.String())
+	}
+	want = []string{
+		"go.go:9:2: call to external package strings would gain ctx",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAnalyzeAmbiguous(t *testing.T) {
+	problems, err := Analyze([]byte(`package p
+
+func work() {}
+
+func run(x interface{ M(int) }) {
+	work()
+	x.M(1)
+	func() {}()
+}
+`), Options{Ambiguous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.String())
+	}
+	want := []string{"go.go:7:2: ambiguous call x.M(1) would gain ctx"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAnalyzeStrict(t *testing.T) {
+	_, err := Analyze([]byte(`package p
+
+import "strings"
+
+func run() { strings.ToUpper("") }
+`), Options{Strict: true})
+	want := "go.go:5:14: cannot classify call to strings.ToUpper"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestReportFuncs(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package p
+
+type T struct{}
+
+func (t *T) M() { work(); work() }
+
+func helper() {}
+
+func work() { helper() }
+`), Options{LeafFuncs: []string{"helper"}, Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FuncReport{
+		{Name: "T.M", Filename: "go.go", Line: 5, Rewritten: true, Calls: 2},
+		{Name: "helper", Filename: "go.go", Line: 7},
+		{Name: "work", Filename: "go.go", Line: 9, Rewritten: true},
+	}
+	if len(report.Funcs) != len(want) {
+		t.Fatalf("got %+v, want %+v", report.Funcs, want)
+	}
+	for i := range want {
+		if report.Funcs[i] != want[i] {
+			t.Errorf("got %+v, want %+v", report.Funcs[i], want[i])
+		}
+	}
+}
+
+func TestSkipFuncValuesWarning(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package p
+
+func handler() {}
+
+var h = handler
+`), Options{SkipFuncValues: true, Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "go.go:3:1: handler is used as a value; not adding ctx"
+	if len(report.Warnings) != 1 || report.Warnings[0] != want {
+		t.Errorf("got %q, want %q", report.Warnings, want)
+	}
+}
+
+func TestAmbiguousExemptCallWarning(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package p
+
+type File struct{}
+
+func (f *File) Close() error { return nil }
+
+type Job struct{ f *File }
+
+func (j *Job) Close() { j.f.Close() }
+`), Options{Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "go.go:9:25: j.f.Close may be a call to a method that gains ctx; " +
+		"leaving it alone"
+	if len(report.Warnings) != 1 || report.Warnings[0] != want {
+		t.Errorf("got %q, want %q", report.Warnings, want)
+	}
+}
+
+func TestWarnUnusedCtx(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package p
+
+func leaf() int { return 1 }
+
+func run() { leaf() }
+`), Options{WarnUnusedCtx: true, Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "go.go:3:1: leaf doesn't use its new ctx parameter"
+	if len(report.Warnings) != 1 || report.Warnings[0] != want {
+		t.Errorf("got %q, want %q", report.Warnings, want)
+	}
+}
+
+func TestDocumentCtxRerun(t *testing.T) {
+	source := `package p
+
+// Work does the work.
+func Work() {}
+
+func run() { Work() }
+`
+	want := `package p
+
+import "context"
+
+// Work does the work.
+// ctx carries request-scoped values and cancellation.
+func Work(ctx context.Context) {}
+
+// ctx carries request-scoped values and cancellation.
+func run(ctx context.Context) { Work(ctx) }
+`
+	got, err := ProcessWith([]byte(source), Options{DocumentCtx: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	got, err = ProcessWith(got, Options{DocumentCtx: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("rerun got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDocumentCtxDirectives(t *testing.T) {
+	source := `package p
+
+// Work does the work.
+//go:noinline
+func Work() {}
+
+// Run runs.
+//
+//go:noinline
+func Run() { Work() }
+
+//go:noinline
+func run() { Work() }
+`
+	want := `package p
+
+import "context"
+
+// Work does the work.
+// ctx carries request-scoped values and cancellation.
+//
+//go:noinline
+func Work(ctx context.Context) {}
+
+// Run runs.
+// ctx carries request-scoped values and cancellation.
+//
+//go:noinline
+func Run(ctx context.Context) { Work(ctx) }
+
+// ctx carries request-scoped values and cancellation.
+//
+//go:noinline
+func run(ctx context.Context) { Work(ctx) }
+`
+	got, err := ProcessWith([]byte(source), Options{DocumentCtx: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	formatted, err := format.Source(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != want {
+		t.Errorf("gofmt changed the output to:\n%s", formatted)
+	}
+}
+
+func TestReportImports(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package p\n\nfunc a() {}\n",
+		"b.go": "package p\n\nimport \"golang.org/x/net/context\"\n\n" +
+			"func b(ctx context.Context) {}\n",
+		"c.go": "package p\n\ntype T int\n",
+	}
+	report := &Report{}
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		filename := filepath.Join(dir, name)
+		err := ioutil.WriteFile(filename, []byte(files[name]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = ReadAndProcess(filename, Options{Report: report})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := fmt.Sprint(report.ImportAdded),
+		fmt.Sprint([]string{filepath.Join(dir, "a.go")}); got != want {
+		t.Errorf("got ImportAdded %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(report.ImportPresent),
+		fmt.Sprint([]string{filepath.Join(dir, "b.go")}); got != want {
+		t.Errorf("got ImportPresent %s, want %s", got, want)
+	}
+}
+
+func TestTags(t *testing.T) {
+	body := "package p\n\nfunc work() {}\n"
+	for _, test := range []struct {
+		constraint string
+		rewritten  bool
+	}{
+		{"", true},
+		{"//go:build linux\n\n", true},
+		{"//go:build linux && amd64\n\n", true},
+		{"//go:build darwin\n\n", false},
+		{"//go:build !amd64\n\n", false},
+	} {
+		source := test.constraint + body
+		got, err := ProcessWith([]byte(source),
+			Options{Tags: []string{"linux", "amd64"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten := string(got) != source; rewritten != test.rewritten {
+			t.Errorf("%q: got rewritten %v, want %v", test.constraint,
+				rewritten, test.rewritten)
+		}
+	}
+}
+
+func TestCheckContextType(t *testing.T) {
+	if err := CheckContextType(Options{StdlibContext: true}); err != nil {
+		t.Errorf("standard library context: %v", err)
+	}
+	err := CheckContextType(Options{ImportPath: "errors"})
+	want := `package "errors" doesn't export a Context type`
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+	err = CheckContextType(Options{ImportPath: "example.com/no/such/pkg"})
+	if err == nil || !strings.HasPrefix(err.Error(),
+		`can't load context package "example.com/no/such/pkg": `) {
+		t.Errorf("got %v for a missing package", err)
+	}
+}
+
+func TestCodemod(t *testing.T) {
+	report := &Report{}
+	_, err := ProcessWith([]byte(`package store
+
+import "context"
+
+type DB struct{}
+
+func (db *DB) Get(key string) ([]byte, error) { return db.get(key) }
+
+func (db *DB) get(key string) ([]byte, error) { return nil, nil }
+
+func Open(path string) *DB { return nil }
+
+var _ context.Context
+`), Options{Report: report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(report.Codemod(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "version": 1,
+  "changes": [
+    {
+      "package": "store",
+      "name": "Open",
+      "old": "Open(path string) *DB",
+      "new": "Open(ctx context.Context, path string) *DB",
+      "param": {
+        "index": 0,
+        "name": "ctx",
+        "import": "context"
+      }
+    },
+    {
+      "package": "store",
+      "receiver": "*DB",
+      "name": "Get",
+      "old": "Get(key string) ([]byte, error)",
+      "new": "Get(ctx context.Context, key string) ([]byte, error)",
+      "param": {
+        "index": 0,
+        "name": "ctx",
+        "import": "context"
+      }
+    }
+  ]
+}`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCodemodImport(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		opts   Options
+		source string
+		want   string
+	}{
+		{"added", Options{}, "package p\n\nfunc Get() {}\n",
+			"context"},
+		{"reused", Options{ImportPath: "context"},
+			"package p\n\nimport \"golang.org/x/net/context\"\n\n" +
+				"func Get() {}\n\nvar _ context.Context\n",
+			"golang.org/x/net/context"},
+		{"migrated", Options{StdlibContext: true},
+			"package p\n\nimport \"golang.org/x/net/context\"\n\n" +
+				"func Get() {}\n\nvar _ context.Context\n",
+			"context"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Report = &Report{}
+			_, err := ProcessWith([]byte(test.source), test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes := test.opts.Report.Codemod().Changes
+			if len(changes) != 1 || changes[0].Param.Import != test.want {
+				t.Errorf("got %+v, want import %q", changes, test.want)
+			}
+		})
+	}
+}
+
+func TestStampVersion(t *testing.T) {
+	opts := Options{StampVersion: true}
+	out, err := ProcessWith([]byte("package p\n\nfunc work() {}\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\n" + versionStampPrefix + Version + "\n\n" +
+		"import \"context\"\n\n" +
+		"func work(ctx context.Context) {}\n"
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	// a stamp from an older version is replaced, not added to
+	old := strings.Replace(string(out), Version, "v0.0.1", 1)
+	out, err = ProcessWith([]byte(old), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	// the stamp goes below comments on the package line, and only a stamp
+	// where one is written is replaced
+	source := "package p // import \"example.com/p\"\n\n" +
+		"// ctxrewriter: v0.0.1\n\nfunc work() {}\n\n" +
+		"// ctxrewriter: this one is just a comment\n"
+	out, err = ProcessWith([]byte(source), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "package p // import \"example.com/p\"\n\n" +
+		versionStampPrefix + Version + "\n\n" +
+		"import \"context\"\n\n" +
+		"func work(ctx context.Context) {}\n\n" +
+		"// ctxrewriter: this one is just a comment\n"
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
@@ -0,0 +1,262 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+// diffLine is a single line of a line-based diff.
+type diffLine struct {
+	Op   diffOp
+	Text string
+}
+
+// splitLines splits source into lines, without their trailing newlines.
+func splitLines(source []byte) []string {
+	if len(source) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(source), "\n"), "\n")
+}
+
+// diffLines returns a minimal line diff turning a into b, computed with
+// Myers' algorithm, which takes time proportional to the number of lines
+// times the number of differences, and linear space. Deletions come before
+// insertions within each changed region.
+func diffLines(a, b []string) []diffLine {
+	lines := myersDiff(nil, a, b)
+
+	// deletions before insertions in each changed region, which the halves
+	// myersDiff joins can leave the other way around
+	for i := 0; i < len(lines); {
+		if lines[i].Op == diffEqual {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lines) && lines[j].Op != diffEqual {
+			j++
+		}
+		region := lines[i:j]
+		sort.SliceStable(region, func(k, l int) bool {
+			return region[k].Op == diffDelete && region[l].Op == diffInsert
+		})
+		i = j
+	}
+	return lines
+}
+
+// myersDiff appends a minimal diff turning a into b to lines. Lines common
+// to the start and end of both are matched directly. What's left is split
+// where the shortest edit script's forward and reverse halves meet, and each
+// part is diffed in turn.
+func myersDiff(lines []diffLine, a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, line := range a[:prefix] {
+		lines = append(lines, diffLine{diffEqual, line})
+	}
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	x, y := -1, -1
+	if len(middleA) > 0 && len(middleB) > 0 {
+		x, y = middleSnake(middleA, middleB)
+	}
+	if x < 0 {
+		for _, line := range middleA {
+			lines = append(lines, diffLine{diffDelete, line})
+		}
+		for _, line := range middleB {
+			lines = append(lines, diffLine{diffInsert, line})
+		}
+	} else {
+		lines = myersDiff(lines, middleA[:x], middleB[:y])
+		lines = myersDiff(lines, middleA[x:], middleB[y:])
+	}
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{diffEqual, line})
+	}
+	return lines
+}
+
+// middleSnake searches for a shortest edit script turning a into b from both
+// ends at once, and returns the point in a and b where the two searches
+// meet, through which some shortest edit script passes. x is -1 if a and b
+// have no lines in common.
+func middleSnake(a, b []string) (x, y int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[offset+k] is the furthest x reached on diagonal k = x-y from
+	// the start, and reverse[offset+k] the furthest reached from the end,
+	// counting x and y back from it.
+	forward := make([]int, 2*offset+1)
+	reverse := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i], reverse[i] = -1, -1
+	}
+	forward[offset+1], reverse[offset+1] = 0, 0
+	delta := n - m
+	// the forward search checks for meeting the reverse one only if delta
+	// is odd, and the reverse search only if it's even
+	odd := delta%2 != 0
+	// diagonals at the ends of the ranges searched that have left the grid
+	var forwardStart, forwardEnd, reverseStart, reverseEnd int
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			// down from diagonal k+1 or right from k-1
+			x := forward[offset+k-1] + 1
+			if k == -d || (k != d && x <= forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch {
+			case x > n:
+				forwardEnd += 2
+			case y > m:
+				forwardStart += 2
+			case odd:
+				rk := offset + delta - k
+				if rk >= 0 && rk < len(reverse) && reverse[rk] != -1 &&
+					x >= n-reverse[rk] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + reverseStart; k <= d-reverseEnd; k += 2 {
+			x := reverse[offset+k-1] + 1
+			if k == -d || (k != d && x <= reverse[offset+k+1]) {
+				x = reverse[offset+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			reverse[offset+k] = x
+			switch {
+			case x > n:
+				reverseEnd += 2
+			case y > m:
+				reverseStart += 2
+			case !odd:
+				fk := offset + delta - k
+				if fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+					fx := forward[fk]
+					if fx >= n-x {
+						return fx, fx - (fk - offset)
+					}
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// diffContext is the number of unchanged lines shown around each hunk of a
+// unified diff.
+const diffContext = 3
+
+// UnifiedDiff returns a unified diff from original to processed, the
+// contents of filename before and after rewriting, or nil if they're the
+// same.
+func UnifiedDiff(filename string, original, processed []byte) []byte {
+	lines := diffLines(splitLines(original), splitLines(processed))
+	// before[i] and after[i] count the original and processed lines
+	// preceding lines[i].
+	before := make([]int, len(lines)+1)
+	after := make([]int, len(lines)+1)
+	for i, line := range lines {
+		before[i+1], after[i+1] = before[i], after[i]
+		if line.Op != diffInsert {
+			before[i+1]++
+		}
+		if line.Op != diffDelete {
+			after[i+1]++
+		}
+	}
+
+	var out bytes.Buffer
+	for i := 0; i < len(lines); {
+		if lines[i].Op == diffEqual {
+			i++
+			continue
+		}
+		// extend the hunk over later changes separated from it by too
+		// few unchanged lines to be worth splitting.
+		end := i
+		for j := i; j < len(lines); {
+			if lines[j].Op != diffEqual {
+				j++
+				end = j
+				continue
+			}
+			k := j
+			for k < len(lines) && lines[k].Op == diffEqual {
+				k++
+			}
+			if k == len(lines) || k-j > 2*diffContext {
+				break
+			}
+			j = k
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end += diffContext
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", filename, filename)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(before[start], before[end]),
+			hunkRange(after[start], after[end]))
+		for _, line := range lines[start:end] {
+			out.WriteString(" -+"[line.Op:line.Op+1] + line.Text + "\n")
+		}
+		i = end
+	}
+	if out.Len() == 0 {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// hunkRange formats the lines from start to end, counted from zero, as a
+// unified diff hunk range.
+func hunkRange(start, end int) string {
+	if end-start == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	if end == start {
+		// an empty range names the line before it
+		return strconv.Itoa(start) + ",0"
+	}
+	return strconv.Itoa(start+1) + "," + strconv.Itoa(end-start)
+}
@@ -0,0 +1,97 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+const ctxDocSuffix = " carries request-scoped values and cancellation."
+
+// documentCtx adds a "// ctx carries ..." line to the end of the doc comment
+// of each of source's top-level functions listed in names, keyed by the
+// function's index among the file's function declarations, with the value
+// being the name of its ctx parameter. Functions already documented this way
+// are left alone.
+func documentCtx(source []byte, names map[int]string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", source, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var offsets []int
+	var lines []string
+	index := 0
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		name, ok := names[index]
+		index++
+		if !ok {
+			continue
+		}
+		line := "// " + name + ctxDocSuffix
+		if fn.Doc != nil && strings.Contains(fn.Doc.Text(), line[3:]) {
+			continue
+		}
+		at := fn.Pos()
+		if fn.Doc != nil {
+			// the line goes above any directives, such as //go:noinline,
+			// which are kept apart from the text by a blank line as gofmt
+			// does
+			list := fn.Doc.List
+			n := len(list)
+			for n > 0 && isDirective(list[n-1].Text) {
+				n--
+			}
+			switch {
+			case n == len(list):
+			case n > 0 && list[n-1].Text == "//":
+				at = list[n-1].Pos()
+			default:
+				at = list[n].Pos()
+				line += "\n//"
+			}
+		}
+		pos := fset.Position(at)
+		offsets = append(offsets, pos.Offset-(pos.Column-1))
+		lines = append(lines, line)
+	}
+
+	var out bytes.Buffer
+	last := 0
+	for i, offset := range offsets {
+		out.Write(source[last:offset])
+		out.WriteString(lines[i] + "\n")
+		last = offset
+	}
+	out.Write(source[last:])
+	return out.Bytes(), nil
+}
+
+// isDirective reports whether c, a comment's text, is a directive like
+// //go:noinline or //export, as go/ast recognizes them.
+func isDirective(c string) bool {
+	if strings.HasPrefix(c, "//line ") || strings.HasPrefix(c, "//extern ") ||
+		strings.HasPrefix(c, "//export ") {
+		return true
+	}
+	colon := strings.Index(c, ":")
+	if !strings.HasPrefix(c, "//") || colon <= 2 || colon+1 >= len(c) {
+		return false
+	}
+	for i := 2; i <= colon+1; i++ {
+		if i == colon {
+			continue
+		}
+		b := c[i]
+		if !('a' <= b && b <= 'z' || '0' <= b && b <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package ctxrewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// DefaultExemptMethods are the method signatures left alone when
+// Options.ExemptMethods is nil: methods of common interfaces from the
+// standard library, which stop satisfying them if they gain ctx.
+var DefaultExemptMethods = []string{
+	// error and fmt
+	"Error() string",
+	"String() string",
+	"GoString() string",
+	"Format(fmt.State, rune)",
+
+	// io
+	"Read([]byte) (int, error)",
+	"Write([]byte) (int, error)",
+	"Close() error",
+	"Seek(int64, int) (int64, error)",
+	"ReadAt([]byte, int64) (int, error)",
+	"WriteAt([]byte, int64) (int, error)",
+	"ReadFrom(io.Reader) (int64, error)",
+	"WriteTo(io.Writer) (int64, error)",
+	"ReadByte() (byte, error)",
+	"UnreadByte() error",
+	"WriteByte(byte) error",
+	"ReadRune() (rune, int, error)",
+	"UnreadRune() error",
+	"WriteString(string) (int, error)",
+
+	// sort
+	"Len() int",
+	"Less(int, int) bool",
+	"Swap(int, int)",
+
+	// net/http
+	"ServeHTTP(http.ResponseWriter, *http.Request)",
+	"RoundTrip(*http.Request) (*http.Response, error)",
+	"Header() http.Header",
+	"WriteHeader(int)",
+	"Flush()",
+}
+
+// parseMethodSignature parses a method signature as used in
+// Options.ExemptMethods, like "Read([]byte) (int, error)".
+func parseMethodSignature(sig string) (name string, ft *ast.FuncType,
+	err error) {
+	paren := strings.IndexByte(sig, '(')
+	if paren < 0 {
+		return "", nil, fmt.Errorf("invalid method signature %q", sig)
+	}
+	name = strings.TrimSpace(sig[:paren])
+	expr, err := parser.ParseExpr("func" + sig[paren:])
+	ft, ok := expr.(*ast.FuncType)
+	if err != nil || !ok || !token.IsIdentifier(name) {
+		return "", nil, fmt.Errorf("invalid method signature %q", sig)
+	}
+	return name, ft, nil
+}
+
+// methodSignature formats a method's name and parameter and result types,
+// without parameter names, so signatures can be compared however they were
+// written.
+func methodSignature(name string, ft *ast.FuncType) string {
+	params := fieldTypes(ft.Params)
+	results := fieldTypes(ft.Results)
+	sig := name + "(" + strings.Join(params, ", ") + ")"
+	switch len(results) {
+	case 0:
+		return sig
+	case 1:
+		return sig + " " + results[0]
+	}
+	return sig + " (" + strings.Join(results, ", ") + ")"
+}
+
+func fieldTypes(fields *ast.FieldList) []string {
+	if fields == nil {
+		return nil
+	}
+	var list []string
+	for _, field := range fields.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			list = append(list, types.ExprString(field.Type))
+		}
+	}
+	return list
+}
+
+// exemptMethods returns the signatures of the methods exempted by opts, and
+// for recognizing calls to them, their names with their argument counts, as
+// formatted by methodCall.
+func exemptMethods(opts Options) (sigs, calls map[string]bool) {
+	patterns := opts.ExemptMethods
+	if patterns == nil {
+		patterns = DefaultExemptMethods
+	}
+	sigs, calls = map[string]bool{}, map[string]bool{}
+	for _, pattern := range patterns {
+		name, ft, err := parseMethodSignature(pattern)
+		if err != nil {
+			// CheckOptions reports these
+			continue
+		}
+		sigs[methodSignature(name, ft)] = true
+		calls[methodCall(name, len(fieldTypes(ft.Params)))] = true
+	}
+	return sigs, calls
+}
+
+func methodCall(name string, args int) string {
+	return fmt.Sprintf("%s/%d", name, args)
+}
+
+// exemptMethod reports whether the method name with type ft has one of the
+// signatures in Options.ExemptMethods.
+func (r *rewriter) exemptMethod(name string, ft *ast.FuncType) bool {
+	return r.exemptSigs[methodSignature(name, ft)]
+}
+
+// keepsSignature reports whether the method name of the type typ, with
+// type ft, is left alone: it's exempt, or skipped like a fenced-off method.
+func (r *rewriter) keepsSignature(typ, name string, ft *ast.FuncType) bool {
+	return r.exemptMethod(name, ft) || r.skippedMethods[name][typ]
+}
+
+// exemptCall reports whether call looks like a call to a method that keeps
+// its signature: one of the methods in Options.ExemptMethods, going by a
+// method call's name and number of arguments, or a skipped method, going by
+// its name. If the call is on the enclosing method's receiver and its type
+// has a method of that name, the call is exempt only if that method keeps
+// its signature. Otherwise the receiver's type isn't known, so the call is
+// left alone if any of the methods of that name the file (or package)
+// declares keeps its signature, with a warning if others of them gain ctx.
+func (r *rewriter) exemptCall(call *ast.CallExpr) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || call.Ellipsis.IsValid() {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if ok && r.imports[x.Name] != "" {
+		// a package's function, not a method
+		return false
+	}
+	name := sel.Sel.Name
+	if !r.exemptCalls[methodCall(name, len(call.Args))] &&
+		len(r.skippedMethods[name]) == 0 {
+		return false
+	}
+	if ok && x.Name == r.recvName {
+		if ft := r.symbols.methods[r.recvType][name]; ft != nil {
+			return r.keepsSignature(r.recvType, name, ft)
+		}
+	}
+	exempt, gains := false, false
+	for typ, methods := range r.symbols.methods {
+		if ft := methods[name]; ft == nil {
+			continue
+		} else if r.keepsSignature(typ, name, ft) {
+			exempt = true
+		} else {
+			gains = true
+		}
+	}
+	if exempt && gains {
+		r.warn(call, "%s may be a call to a method that gains ctx; "+
+			"leaving it alone", types.ExprString(call.Fun))
+	}
+	return exempt || !gains
+}
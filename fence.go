@@ -0,0 +1,54 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+const (
+	fenceOff = "ctxrewriter:off"
+	fenceOn  = "ctxrewriter:on"
+)
+
+// fence is a region of a file, between a "// ctxrewriter:off" comment and
+// the next "// ctxrewriter:on" comment, that the rewrite leaves alone.
+type fence struct {
+	start, end token.Pos
+}
+
+// fences finds the fenced regions of f. A region left open runs to the end
+// of the file.
+func fences(f *ast.File) []fence {
+	var found []fence
+	var start token.Pos
+	for _, group := range f.Comments {
+		for _, comment := range group.List {
+			text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+			switch {
+			case text == fenceOff && !start.IsValid():
+				start = comment.Pos()
+			case text == fenceOn && start.IsValid():
+				found = append(found, fence{start, comment.End()})
+				start = token.NoPos
+			}
+		}
+	}
+	if start.IsValid() {
+		found = append(found, fence{start, f.End()})
+	}
+	return found
+}
+
+// fenced reports whether node lies entirely within a fenced region.
+func (r *rewriter) fenced(node ast.Node) bool {
+	if len(r.fences) == 0 || !node.Pos().IsValid() {
+		return false
+	}
+	for _, fence := range r.fences {
+		if node.Pos() >= fence.start && node.End() <= fence.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// funcValues returns the names of f's top-level functions that are referred
+// to other than by calling them, e.g. `handler` in `http.HandleFunc("/",
+// handler)`. This is a best-effort, purely syntactic check: it doesn't know
+// about shadowing, so a local variable with the same name as a function
+// also counts.
+func funcValues(f *ast.File) map[string]bool {
+	funcs := map[string]bool{}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+			funcs[fn.Name.Name] = true
+		}
+	}
+
+	// identifiers that are the callee of a call, a selector's field or
+	// method name, a composite literal key, or a declared name aren't uses
+	// as values.
+	ignore := map[*ast.Ident]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.CallExpr:
+			if ident, ok := v.Fun.(*ast.Ident); ok {
+				ignore[ident] = true
+			}
+		case *ast.SelectorExpr:
+			ignore[v.Sel] = true
+		case *ast.KeyValueExpr:
+			if ident, ok := v.Key.(*ast.Ident); ok {
+				ignore[ident] = true
+			}
+		case *ast.FuncDecl:
+			ignore[v.Name] = true
+		}
+		return true
+	})
+
+	values := map[string]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && funcs[ident.Name] &&
+			!ignore[ident] {
+			values[ident.Name] = true
+		}
+		return true
+	})
+	return values
+}
+
+// typedFuncValue reports whether fun, the function of a call, is a value of
+// a func type, like a variable, a parameter, a struct field, an interface's
+// method, a value received from a channel or a conversion to a func type
+// literal, rather than a function or function literal. Under SkipTypeDecls
+// those types don't gain ctx, so neither may calls through them. Variables
+// declared with a function literal or one of the file's functions as their
+// value count as functions, since that value's signature does gain ctx.
+func (r *rewriter) typedFuncValue(fun ast.Expr) bool {
+	if index, ok := fun.(*ast.IndexExpr); ok && !r.instantiation(index) {
+		// an element of a map or slice of funcs, like m["k"]
+		return true
+	}
+	switch v := uninstantiated(fun).(type) {
+	case *ast.ParenExpr:
+		return r.typedFuncValue(v.X)
+	case *ast.UnaryExpr:
+		// a func received from a channel, like (<-c)
+		return v.Op == token.ARROW
+	case *ast.CallExpr:
+		// a conversion like (func(int))(fn)
+		return len(v.Args) == 1 && isFuncTypeLiteral(v.Fun)
+	case *ast.Ident:
+		if r.variable(v) {
+			return !r.rewrittenValue(v)
+		}
+		return v.Obj != nil && v.Obj.Kind == ast.Var && !r.rewrittenValue(v)
+	case *ast.SelectorExpr:
+		if r.variable(v.Sel) {
+			return true
+		}
+		// a func field, or a method only interfaces declare
+		name := v.Sel.Name
+		return (r.symbols.funcFields[name] ||
+			r.symbols.hasIfaceMethod(name)) &&
+			!r.symbols.hasConcreteMethod(name)
+	}
+	return false
+}
+
+// instantiation reports whether index instantiates a generic function,
+// like f[int], rather than indexing a map or slice. Methods can't have type
+// parameters, so the only functions it can instantiate are the file's and
+// other packages'.
+func (r *rewriter) instantiation(index *ast.IndexExpr) bool {
+	switch x := index.X.(type) {
+	case *ast.Ident:
+		if x.Obj != nil {
+			return x.Obj.Kind == ast.Fun
+		}
+		return r.localFuncs[x.Name]
+	case *ast.SelectorExpr:
+		pkg, ok := x.X.(*ast.Ident)
+		return ok && r.imports[pkg.Name] != ""
+	}
+	return false
+}
+
+// rewrittenValue reports whether the variable ident is declared with a value
+// whose signature the rewrite changes: a function literal, one of the
+// file's top-level functions or a method value.
+func (r *rewriter) rewrittenValue(ident *ast.Ident) bool {
+	switch v := declaredValue(ident).(type) {
+	case *ast.FuncLit:
+		return true
+	case *ast.Ident:
+		return r.localFuncs[v.Name] && !r.skipped[v.Name]
+	case *ast.SelectorExpr:
+		// a method value
+		return r.symbols.hasConcreteMethod(v.Sel.Name)
+	}
+	return false
+}
+
+func isFuncTypeLiteral(expr ast.Expr) bool {
+	_, ok := unparen(expr).(*ast.FuncType)
+	return ok
+}
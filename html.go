@@ -0,0 +1,132 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+	"html/template"
+	"strings"
+)
+
+var htmlDiffTemplate = template.Must(template.New("diff").Parse(`<div class="ctxrewriter-diff">
+<div class="filename">{{.Filename}}</div>
+<table>
+{{range .Lines}}<tr class="{{.Class}}"><td class="line">{{if .Old}}{{.Old}}{{end}}</td><td class="line">{{if .New}}{{.New}}{{end}}</td><td class="marker">{{.Marker}}</td><td><pre>{{.Text}}</pre></td></tr>
+{{end}}</table>
+</div>
+<style>
+.ctxrewriter-diff table { border-collapse: collapse; font-family: monospace; }
+.ctxrewriter-diff pre { margin: 0; }
+.ctxrewriter-diff .line { color: #888; text-align: right; padding: 0 4px; }
+.ctxrewriter-diff .del { background: #fdd; }
+.ctxrewriter-diff .ins { background: #dfd; }
+.ctxrewriter-diff .keyword { color: #00c; font-weight: bold; }
+.ctxrewriter-diff .string { color: #a31515; }
+.ctxrewriter-diff .number { color: #098658; }
+.ctxrewriter-diff .comment { color: #080; font-style: italic; }
+</style>
+`))
+
+type htmlDiffLine struct {
+	Class, Marker string
+	Text          template.HTML
+	// Old and New are the line's numbers in the original and rewritten
+	// source, or 0 if it isn't in one of them.
+	Old, New int
+}
+
+// HTMLDiff renders the changes from original to processed, the contents of
+// filename before and after rewriting, as an HTML fragment suitable for
+// embedding in a web page. Every line of both versions is shown, with
+// removed lines marked "-" and added lines marked "+", and Go syntax
+// highlighted.
+func HTMLDiff(filename string, original, processed []byte) ([]byte, error) {
+	var lines []htmlDiffLine
+	oldText, newText := highlight(original), highlight(processed)
+	oldLine, newLine := 0, 0
+	for _, line := range diffLines(splitLines(original), splitLines(processed)) {
+		var l htmlDiffLine
+		switch line.Op {
+		case diffEqual:
+			oldLine++
+			newLine++
+			l.Old, l.New = oldLine, newLine
+			l.Text = newText[newLine-1]
+		case diffDelete:
+			oldLine++
+			l.Old, l.Class, l.Marker = oldLine, "del", "-"
+			l.Text = oldText[oldLine-1]
+		case diffInsert:
+			newLine++
+			l.New, l.Class, l.Marker = newLine, "ins", "+"
+			l.Text = newText[newLine-1]
+		}
+		lines = append(lines, l)
+	}
+	var out bytes.Buffer
+	err := htmlDiffTemplate.Execute(&out, struct {
+		Filename string
+		Lines    []htmlDiffLine
+	}{filename, lines})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// highlight returns source's lines, split as splitLines does, as escaped
+// HTML with keywords, literals and comments wrapped in spans classed for the
+// stylesheet above. The whole source is scanned at once so that comments and
+// raw strings spanning lines are highlighted throughout; source that isn't
+// valid Go is highlighted as far as the scanner makes sense of it.
+func highlight(source []byte) []template.HTML {
+	classes := make([]string, len(source))
+	file := token.NewFileSet().AddFile("", -1, len(source))
+	var s scanner.Scanner
+	s.Init(file, source, nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		var class string
+		switch {
+		case tok.IsKeyword():
+			class, lit = "keyword", tok.String()
+		case tok == token.STRING || tok == token.CHAR:
+			class = "string"
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			class = "number"
+		case tok == token.COMMENT:
+			class = "comment"
+		default:
+			continue
+		}
+		start := file.Offset(pos)
+		for i := start; i < start+len(lit) && i < len(source); i++ {
+			classes[i] = class
+		}
+	}
+
+	var lines []template.HTML
+	offset := 0
+	for _, line := range splitLines(source) {
+		var out strings.Builder
+		for i := 0; i < len(line); {
+			class := classes[offset+i]
+			j := i + 1
+			for j < len(line) && classes[offset+j] == class {
+				j++
+			}
+			text := template.HTMLEscapeString(line[i:j])
+			if class != "" {
+				text = `<span class="` + class + `">` + text + `</span>`
+			}
+			out.WriteString(text)
+			i = j
+		}
+		lines = append(lines, template.HTML(out.String()))
+		offset += len(line) + 1
+	}
+	return lines
+}
@@ -0,0 +1,176 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// addImport adds an import of path to decls. The import is merged into the
+// file's first import declaration if there is one, to be sorted into place
+// by ast.SortImports. Otherwise a new declaration is added at pos, which
+// should be importPos so that the printer keeps everything above it (build
+// constraints, package docs, comments on the package line) above it, and
+// later comments below it.
+func addImport(decls []ast.Decl, pos token.Pos, path string) []ast.Decl {
+	for i, decl := range decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		c := *gen
+		first := c.Specs[0]
+		if !c.Lparen.IsValid() {
+			c.Lparen = first.Pos()
+			c.Rparen = c.Specs[len(c.Specs)-1].End()
+		}
+		// the new spec shares the first spec's span, so that SortImports
+		// considers them part of the same run.
+		c.Specs = append([]ast.Spec{&ast.ImportSpec{
+			Path: &ast.BasicLit{
+				ValuePos: first.Pos(), Kind: token.STRING, Value: path},
+			EndPos: first.End()}}, c.Specs...)
+		new_decls := append([]ast.Decl(nil), decls...)
+		new_decls[i] = &c
+		return new_decls
+	}
+	return append([]ast.Decl{&ast.GenDecl{
+		TokPos: pos,
+		Tok:    token.IMPORT,
+		Specs: []ast.Spec{&ast.ImportSpec{Path: &ast.BasicLit{
+			ValuePos: pos, Kind: token.STRING, Value: path}}}}}, decls...)
+}
+
+// importPos returns where addImport should add a new import declaration to
+// f: the end of the package clause. If comments follow the package clause
+// on the same line, such as an import comment, or a version stamp follows
+// it, it returns NoPos instead, and positionAdded makes room for the
+// declaration on a line of its own below them.
+func importPos(fset *token.FileSet, f *ast.File) token.Pos {
+	file := fset.File(f.Pos())
+	if packageLineEnd(file, f) != f.Name.End() ||
+		versionStamp(file, f) != nil {
+		return token.NoPos
+	}
+	return f.Name.End()
+}
+
+// packageLineEnd returns the end of the last comment that starts on the
+// line of f's package clause, or of the package clause if there is none.
+func packageLineEnd(file *token.File, f *ast.File) token.Pos {
+	end := f.Name.End()
+	line := file.Line(end)
+	for _, group := range f.Comments {
+		for _, comment := range group.List {
+			if comment.Pos() > f.Name.End() &&
+				file.Line(comment.Pos()) == line {
+				end = comment.End()
+			}
+		}
+	}
+	return end
+}
+
+// hasImport reports whether decls import path.
+func hasImport(decls []ast.Decl, path string) bool {
+	for _, decl := range decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			if spec.(*ast.ImportSpec).Path.Value == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contextImportName returns the name f refers to an existing import of the
+// context package at path by, and whether there is one. Blank and dot imports
+// can't be referred to, so a fresh import is still needed. Without one, the
+// name the fresh import will have is returned.
+func contextImportName(f *ast.File, path string) (string, bool) {
+	for _, imp := range f.Imports {
+		name := importName(imp)
+		if isContextImport(imp, path) && name != "_" && name != "." {
+			return name, true
+		}
+	}
+	return importName(&ast.ImportSpec{Path: &ast.BasicLit{Value: path}}),
+		false
+}
+
+// importName returns the name an import spec is referred to by, assuming the
+// package name is the last element of its path.
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	path, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return ""
+	}
+	return importedName(path)
+}
+
+// isContextImport reports whether spec imports the context package at path.
+// If path is one of the two standard context packages, either one will do,
+// since golang.org/x/net/context's types are aliases of the stdlib ones.
+func isContextImport(spec *ast.ImportSpec, path string) bool {
+	standard := func(path string) bool {
+		return path == netContextImport || path == stdlibContextImport
+	}
+	return spec.Path.Value == path ||
+		(standard(path) && standard(spec.Path.Value))
+}
+
+// pruneContextImports removes imports of the context package at path whose
+// name is never used as a selector qualifier in decls, such as an
+// x/net/context import left behind after migrating to the stdlib package.
+func pruneContextImports(decls []ast.Decl, path string) []ast.Decl {
+	used := map[string]bool{}
+	for _, decl := range decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			continue
+		}
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok {
+					used[x.Name] = true
+				}
+			}
+			return true
+		})
+	}
+
+	new_decls := make([]ast.Decl, 0, len(decls))
+	for _, decl := range decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			new_decls = append(new_decls, decl)
+			continue
+		}
+		new_specs := make([]ast.Spec, 0, len(gen.Specs))
+		for _, spec := range gen.Specs {
+			imp := spec.(*ast.ImportSpec)
+			name := importName(imp)
+			if isContextImport(imp, path) && name != "_" && name != "." &&
+				!used[name] {
+				continue
+			}
+			new_specs = append(new_specs, spec)
+		}
+		if len(new_specs) == 0 {
+			continue
+		}
+		if len(new_specs) != len(gen.Specs) {
+			c := *gen
+			c.Specs = new_specs
+			gen = &c
+		}
+		new_decls = append(new_decls, gen)
+	}
+	return new_decls
+}
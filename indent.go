@@ -0,0 +1,52 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+)
+
+// indentWithSpaces replaces each leading tab of each line of source with n
+// spaces. Lines continuing a multi-line raw string literal are left alone,
+// since changing them would change the string.
+func indentWithSpaces(source []byte, n int) []byte {
+	type span struct{ start, end int }
+	var raw []span
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(source))
+	var s scanner.Scanner
+	s.Init(file, source, nil, 0)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.STRING && len(lit) > 0 && lit[0] == '`' {
+			start := file.Offset(pos)
+			raw = append(raw, span{start, start + len(lit)})
+		}
+	}
+
+	spaces := bytes.Repeat([]byte(" "), n)
+	var out bytes.Buffer
+	offset := 0
+	for _, line := range bytes.SplitAfter(source, []byte("\n")) {
+		inRaw := false
+		for _, r := range raw {
+			if offset > r.start && offset < r.end {
+				inRaw = true
+				break
+			}
+		}
+		if !inRaw {
+			for len(line) > 0 && line[0] == '\t' {
+				out.Write(spaces)
+				line = line[1:]
+				offset++
+			}
+		}
+		out.Write(line)
+		offset += len(line)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,101 @@
+package ctxrewriter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ModulePath returns the module path declared by the go.mod file in dir or
+// its closest parent directory that has one.
+func ModulePath(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) == 2 && fields[0] == "module" {
+					return strings.Trim(fields[1], `"`), nil
+				}
+			}
+			return "", fmt.Errorf("%s: no module declaration",
+				filepath.Join(dir, "go.mod"))
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no go.mod found")
+		}
+		dir = parent
+	}
+}
+
+// fileImports maps the names f's imports are referred to by to their paths.
+func fileImports(f *ast.File) map[string]string {
+	imports := map[string]string{}
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := importedName(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	return imports
+}
+
+// importedPackage returns the import path of the package fun is qualified
+// by, if fun is a package-qualified function like db.Query.
+func (r *rewriter) importedPackage(fun ast.Expr) (string, bool) {
+	sel, ok := fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	path, ok := r.imports[x.Name]
+	return path, ok
+}
+
+// ownPackage reports whether the package at path is part of the module being
+// rewritten: it's under Options.ModulePath, or it's an internal package,
+// which Go only allows importing from within the same tree.
+func (r *rewriter) ownPackage(path string) bool {
+	module := r.opts.ModulePath
+	return path == module || strings.HasPrefix(path, module+"/") ||
+		strings.HasSuffix(path, "/internal") ||
+		strings.Contains(path, "/internal/")
+}
+
+// matchPackages reports whether the import path matches any of patterns, as
+// used by Options.AllowPackages and DenyPackages.
+func matchPackages(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if pattern == "..." || pattern == path {
+			return true
+		}
+		if prefix := strings.TrimSuffix(pattern, "/..."); prefix != pattern &&
+			(path == prefix || strings.HasPrefix(path, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
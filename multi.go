@@ -0,0 +1,48 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const multiFileDelimiter = "//FILE: "
+
+// ProcessMulti rewrites a stream of concatenated files, each introduced by a
+// `//FILE: name.go` line, and returns the rewritten files with the same
+// delimiters. This lets editors batch-rewrite several files at once.
+func ProcessMulti(source []byte, opts Options) ([]byte, error) {
+	var out bytes.Buffer
+	var filename string
+	var file []byte
+	flush := func() error {
+		if filename == "" {
+			if len(bytes.TrimSpace(file)) > 0 {
+				return fmt.Errorf("missing %q line before first file",
+					multiFileDelimiter)
+			}
+			return nil
+		}
+		processed, err := processSource(filename, file, opts)
+		if err != nil {
+			return err
+		}
+		out.WriteString(multiFileDelimiter + filename + "\n")
+		out.Write(processed)
+		return nil
+	}
+	for _, line := range bytes.SplitAfter(source, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte(multiFileDelimiter)) {
+			file = append(file, line...)
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		filename = string(bytes.TrimSpace(line[len(multiFileDelimiter):]))
+		file = nil
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
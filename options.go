@@ -0,0 +1,123 @@
+package ctxrewriter
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Option sets part of an Options, for callers that would rather configure
+// a rewrite as a list of functional options. Options itself serves as the
+// configuration struct; there is no separate Config type.
+type Option func(*Options)
+
+// Configure returns the Options that options set, starting from the
+// defaults, for passing to ProcessWith, ProcessFileWith and the like.
+func Configure(options ...Option) Options {
+	var opts Options
+	for _, option := range options {
+		option(&opts)
+	}
+	return opts
+}
+
+// WithImportPath sets Options.ImportPath.
+func WithImportPath(path string) Option {
+	return func(opts *Options) { opts.ImportPath = path }
+}
+
+// WithVarName sets Options.VarName.
+func WithVarName(name string) Option {
+	return func(opts *Options) { opts.VarName = name }
+}
+
+// WithDefinitions sets whether function signatures gain ctx, which they do
+// by default.
+func WithDefinitions(rewrite bool) Option {
+	return func(opts *Options) { opts.SkipDefinitions = !rewrite }
+}
+
+// WithCalls sets whether calls gain ctx, which they do by default.
+func WithCalls(rewrite bool) Option {
+	return func(opts *Options) { opts.SkipCalls = !rewrite }
+}
+
+// envPrefix begins the names of the environment variables OptionsFromEnv
+// reads.
+const envPrefix = "CTXREWRITER_"
+
+// envOptions are the environment variables OptionsFromEnv reads, less
+// envPrefix, and the Options fields they set. The names follow the
+// ctxrewriter command's flags. Lists are split on sep.
+var envOptions = []struct {
+	name, field, sep string
+}{
+	{"BACKGROUND_GOROUTINES", "BackgroundGoroutines", ""},
+	{"IMPORT", "ImportPath", ""},
+	{"FALLBACK", "Fallback", ""},
+	{"VAR", "VarName", ""},
+	{"PARAM_INDEX", "ParamIndex", ""},
+	{"STDLIB", "StdlibContext", ""},
+	{"STAMP", "StampVersion", ""},
+	{"DOCUMENT", "DocumentCtx", ""},
+	{"KEEP_UNUSED_IMPORTS", "KeepUnusedImports", ""},
+	{"BOUNDARY_THREAD", "BoundaryThread", ""},
+	{"SKIP_FUNC_VALUES", "SkipFuncValues", ""},
+	{"WARN_UNUSED", "WarnUnusedCtx", ""},
+	{"SILENCE_UNUSED", "SilenceUnused", ""},
+	{"SKIP_TYPE_DECLS", "SkipTypeDecls", ""},
+	{"LEAF_FUNCS", "LeafFuncs", ","},
+	{"EXEMPT_METHODS", "ExemptMethods", ";"},
+	{"ONLY_PACKAGE", "OnlyPackage", ""},
+	{"TAGS", "Tags", ","},
+	{"ONLY_CALLS_TO", "OnlyCallsTo", ","},
+	{"ALLOW_PACKAGES", "AllowPackages", ","},
+	{"DENY_PACKAGES", "DenyPackages", ","},
+	{"ONLY_PACKAGE_CALLS", "OnlyPackageCalls", ""},
+	{"STRICT", "Strict", ""},
+	{"INDENT_SPACES", "IndentSpaces", ""},
+	{"MAX_LINE_WIDTH", "MaxLineWidth", ""},
+	{"VALIDATE", "Validate", ""},
+	{"TYPE_CHECK", "TypeCheck", ""},
+}
+
+// OptionsFromEnv returns opts with the options it leaves unset (at their
+// zero values) set from CTXREWRITER_* environment variables, named after
+// the ctxrewriter command's flags: VarName from CTXREWRITER_VAR, ImportPath
+// from CTXREWRITER_IMPORT, LeafFuncs from a comma-separated
+// CTXREWRITER_LEAF_FUNCS, and so on. Options already set, e.g. from flags,
+// take precedence, which suits CI pipelines that configure a default
+// rewrite.
+func OptionsFromEnv(opts Options) (Options, error) {
+	v := reflect.ValueOf(&opts).Elem()
+	for _, env := range envOptions {
+		value, ok := os.LookupEnv(envPrefix + env.name)
+		field := v.FieldByName(env.field)
+		if !ok || !field.IsZero() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s%s: %v", envPrefix, env.name, err)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s%s: %v", envPrefix, env.name, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Slice:
+			if value != "" {
+				field.Set(reflect.ValueOf(strings.Split(value, env.sep)))
+			}
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,277 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+	"sort"
+)
+
+// insertion is a node added by the rewrite, along with the text it stands
+// for and the offset in the original source the text goes at.
+type insertion struct {
+	node   ast.Node
+	offset int
+	prefix string
+	suffix string
+	size   int
+}
+
+// positionAdded moves f, which was parsed with fset and then rewritten, to a
+// new file in fset that makes room for the nodes the rewrite added, and gives
+// those nodes positions in that room. Without this, the added nodes have no
+// positions, and the printer estimates where it is in the file from how much
+// it has written. With the extra text that estimate runs ahead of the
+// source, so comments from further down (e.g. the first comment in a
+// function's body) get printed in the middle of the new parameter.
+func positionAdded(fset *token.FileSet, f *ast.File) {
+	old := fset.File(f.Package)
+	if old == nil {
+		return
+	}
+	insertions := findInsertions(old, f)
+	if len(insertions) == 0 {
+		return
+	}
+	sort.SliceStable(insertions, func(i, j int) bool {
+		return insertions[i].offset < insertions[j].offset
+	})
+
+	// shifted maps an offset in the original source to the new file. The
+	// text added at an offset goes before whatever was there.
+	shifted := func(offset int) int {
+		i := sort.Search(len(insertions), func(i int) bool {
+			return insertions[i].offset > offset
+		})
+		for _, ins := range insertions[:i] {
+			offset += ins.size
+		}
+		return offset
+	}
+
+	total := 0
+	var lines []int
+	starts := make([]int, len(insertions))
+	for i, ins := range insertions {
+		starts[i] = ins.offset + total
+		total += ins.size
+	}
+	for _, line := range oldLines(old) {
+		lines = append(lines, shifted(line)-lineInsertion(insertions, line))
+	}
+	for i, ins := range insertions {
+		text := ins.prefix + layout(ins.node, token.NoPos) + ins.suffix
+		for j := 0; j < len(text); j++ {
+			if text[j] == '\n' {
+				lines = append(lines, starts[i]+j+1)
+			}
+		}
+	}
+	sort.Ints(lines)
+
+	moved := fset.AddFile(old.Name(), -1, old.Size()+total)
+	moved.SetLines(dedupe(lines))
+
+	seen := map[ast.Node]bool{}
+	move := func(n ast.Node) bool {
+		if n == nil || seen[n] {
+			return false
+		}
+		seen[n] = true
+		v := reflect.ValueOf(n).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if field.Type() != reflect.TypeOf(token.NoPos) {
+				continue
+			}
+			pos := token.Pos(field.Int())
+			if !pos.IsValid() || pos < token.Pos(old.Base()) ||
+				pos > token.Pos(old.Base()+old.Size()) {
+				continue
+			}
+			field.SetInt(int64(moved.Base() +
+				shifted(int(pos)-old.Base())))
+		}
+		return true
+	}
+	ast.Inspect(f, move)
+	for _, group := range f.Comments {
+		ast.Inspect(group, move)
+	}
+	for i, ins := range insertions {
+		layout(ins.node,
+			token.Pos(moved.Base()+starts[i]+len(ins.prefix)))
+	}
+}
+
+// lineInsertion returns how much of the text added at the start of a line,
+// at offset line, belongs on the line.
+func lineInsertion(insertions []insertion, line int) int {
+	size := 0
+	for _, ins := range insertions {
+		if ins.offset == line {
+			size += ins.size
+		}
+	}
+	return size
+}
+
+func oldLines(file *token.File) []int {
+	lines := make([]int, 0, file.LineCount())
+	for i := 1; i <= file.LineCount(); i++ {
+		lines = append(lines, file.Offset(file.LineStart(i)))
+	}
+	return lines
+}
+
+func dedupe(sorted []int) []int {
+	var unique []int
+	for i, v := range sorted {
+		if i == 0 || v != sorted[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// findInsertions finds the parameters, arguments, statements and imports f
+// gained from the rewrite, which are the only nodes in it without positions.
+func findInsertions(file *token.File, f *ast.File) []insertion {
+	var insertions []insertion
+	add := func(n ast.Node, pos token.Pos, prefix, suffix string) {
+		if !pos.IsValid() {
+			return
+		}
+		insertions = append(insertions, insertion{
+			node: n, offset: file.Offset(pos), prefix: prefix, suffix: suffix,
+			size: len(prefix) + len(layout(n, token.NoPos)) + len(suffix)})
+	}
+	// list adds the nodes of a comma-separated list that have no position,
+	// given the list's closing position.
+	list := func(n int, at func(int) ast.Node, closing token.Pos) {
+		for i := 0; i < n; i++ {
+			if at(i).Pos().IsValid() {
+				continue
+			}
+			switch {
+			case i+1 < n && at(i+1).Pos().IsValid():
+				add(at(i), at(i+1).Pos(), "", ", ")
+			case i > 0:
+				add(at(i), closing, ", ", "")
+			default:
+				add(at(i), closing, "", "")
+			}
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.BlockStmt:
+			if len(v.List) > 0 && !v.List[0].Pos().IsValid() &&
+				v.Lbrace.IsValid() {
+				add(v.List[0], v.Lbrace+1, "\n", "")
+			}
+		case *ast.CallExpr:
+			list(len(v.Args), func(i int) ast.Node { return v.Args[i] },
+				v.Rparen)
+		case *ast.FieldList:
+			list(len(v.List), func(i int) ast.Node { return v.List[i] },
+				v.Closing)
+		case *ast.GenDecl:
+			// an import added below the package line's trailing comments
+			// or the version stamp
+			if v.Tok == token.IMPORT && !v.TokPos.IsValid() {
+				end := packageLineEnd(file, f)
+				if stamp := versionStamp(file, f); stamp != nil {
+					end = stamp.End()
+				}
+				add(v, lineAfter(file, end), "\n", "\n")
+			}
+		}
+		return true
+	})
+	return insertions
+}
+
+// lineAfter returns the start of the line after pos's, or the end of file
+// if pos is on the last line.
+func lineAfter(file *token.File, pos token.Pos) token.Pos {
+	if line := file.Line(pos); line < file.LineCount() {
+		return file.LineStart(line + 1)
+	}
+	return token.Pos(file.Base() + file.Size())
+}
+
+// layout returns the text of n, a node added by the rewrite, and if pos is
+// valid, positions n's tokens as if that text started at pos.
+func layout(n ast.Node, pos token.Pos) string {
+	var text []byte
+	var walk func(n ast.Node)
+	at := func(p *token.Pos) {
+		if pos.IsValid() {
+			*p = pos + token.Pos(len(text))
+		}
+	}
+	walk = func(n ast.Node) {
+		switch v := n.(type) {
+		case *ast.AssignStmt:
+			for i, expr := range v.Lhs {
+				if i > 0 {
+					text = append(text, ", "...)
+				}
+				walk(expr)
+			}
+			text = append(text, ' ')
+			at(&v.TokPos)
+			text = append(text, v.Tok.String()+" "...)
+			for i, expr := range v.Rhs {
+				if i > 0 {
+					text = append(text, ", "...)
+				}
+				walk(expr)
+			}
+		case *ast.CallExpr:
+			walk(v.Fun)
+			at(&v.Lparen)
+			text = append(text, '(')
+			for i, arg := range v.Args {
+				if i > 0 {
+					text = append(text, ", "...)
+				}
+				walk(arg)
+			}
+			at(&v.Rparen)
+			text = append(text, ')')
+		case *ast.Field:
+			for i, name := range v.Names {
+				if i > 0 {
+					text = append(text, ", "...)
+				}
+				walk(name)
+			}
+			if len(v.Names) > 0 {
+				text = append(text, ' ')
+			}
+			walk(v.Type)
+		case *ast.GenDecl:
+			at(&v.TokPos)
+			text = append(text, v.Tok.String()+" "...)
+			for _, spec := range v.Specs {
+				walk(spec)
+			}
+		case *ast.ImportSpec:
+			walk(v.Path)
+		case *ast.BasicLit:
+			at(&v.ValuePos)
+			text = append(text, v.Value...)
+		case *ast.Ident:
+			at(&v.NamePos)
+			text = append(text, v.Name...)
+		case *ast.SelectorExpr:
+			walk(v.X)
+			text = append(text, '.')
+			walk(v.Sel)
+		}
+	}
+	walk(n)
+	return string(text)
+}
@@ -0,0 +1,165 @@
+package ctxrewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+)
+
+// Report collects details of what a rewrite did. Set Options.Report to have
+// it filled in; a single Report may be shared across many files.
+type Report struct {
+	Funcs []FuncReport
+
+	// Warnings lists, as "file:line: message", things the user may need to
+	// fix up by hand.
+	Warnings []string
+
+	// ImportAdded lists the files that gained a context import, and
+	// ImportPresent the files that already had one.
+	ImportAdded   []string
+	ImportPresent []string
+
+	// Signatures maps the package-qualified names (e.g. "pkg.T.M") of the
+	// functions that gained a ctx parameter to their old and new
+	// signatures, for updating callers in other repositories.
+	Signatures map[string]SignatureChange
+
+	// Unchanged lists the files the rewrite left exactly as they were,
+	// including those skipped because of OnlyPackage or Tags.
+	Unchanged []string
+
+	// codemod holds the exported signature changes, for Codemod.
+	codemod []CodemodChange
+}
+
+// SignatureChange is the signature of a function before and after the
+// rewrite, written like "M(x int) error".
+type SignatureChange struct {
+	Old string
+	New string
+}
+
+// FuncReport describes the rewrite of a single function declaration.
+type FuncReport struct {
+	// Name is the function name, qualified by receiver type for methods
+	// (e.g. "T.M").
+	Name     string
+	Filename string
+	Line     int
+	// Rewritten is true if the function gained a ctx parameter.
+	Rewritten bool
+	// Calls is the number of calls within the function that gained a ctx
+	// argument.
+	Calls int
+}
+
+// funcName returns the name of fn, qualified by receiver type for methods.
+func funcName(fn *ast.FuncDecl) string {
+	if typ := receiverType(fn); typ != "" {
+		return typ + "." + fn.Name.Name
+	}
+	return fn.Name.Name
+}
+
+// receiverType returns the name of the type fn is a method of, or "" if fn
+// isn't a method.
+func receiverType(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return ""
+	}
+	typ := fn.Recv.List[0].Type
+	for {
+		switch v := typ.(type) {
+		case *ast.StarExpr:
+			typ = v.X
+			continue
+		case *ast.IndexExpr:
+			typ = v.X
+			continue
+		case *ast.IndexListExpr:
+			typ = v.X
+			continue
+		case *ast.ParenExpr:
+			typ = v.X
+			continue
+		case *ast.Ident:
+			return v.Name
+		}
+		return ""
+	}
+}
+
+// merge adds what other recorded to the report.
+func (r *Report) merge(other *Report) {
+	r.Funcs = append(r.Funcs, other.Funcs...)
+	r.Warnings = append(r.Warnings, other.Warnings...)
+	r.ImportAdded = append(r.ImportAdded, other.ImportAdded...)
+	r.ImportPresent = append(r.ImportPresent, other.ImportPresent...)
+	for name, change := range other.Signatures {
+		if r.Signatures == nil {
+			r.Signatures = map[string]SignatureChange{}
+		}
+		r.Signatures[name] = change
+	}
+	r.Unchanged = append(r.Unchanged, other.Unchanged...)
+	r.codemod = append(r.codemod, other.codemod...)
+}
+
+// reportFunc records fn in the report, if there is one.
+func (r *rewriter) reportFunc(fn *ast.FuncDecl, rewritten bool, calls int) {
+	if r.opts.Report == nil {
+		return
+	}
+	pos := r.fset.Position(fn.Pos())
+	r.opts.Report.Funcs = append(r.opts.Report.Funcs, FuncReport{
+		Name:      funcName(fn),
+		Filename:  pos.Filename,
+		Line:      pos.Line,
+		Rewritten: rewritten,
+		Calls:     calls,
+	})
+}
+
+// warn adds a warning about node to the report, if there is one.
+func (r *rewriter) warn(node ast.Node, format string, args ...interface{}) {
+	if r.opts.Report == nil {
+		return
+	}
+	r.opts.Report.Warnings = append(r.opts.Report.Warnings,
+		r.fset.Position(node.Pos()).String()+": "+fmt.Sprintf(format, args...))
+}
+
+// reportImport records whether the file f gained a context import, given
+// whether it already had one, in the report, if there is one.
+func (r *rewriter) reportImport(f *ast.File, had, has bool) {
+	if r.opts.Report == nil {
+		return
+	}
+	filename := r.fset.Position(f.Pos()).Filename
+	if had {
+		r.opts.Report.ImportPresent = append(r.opts.Report.ImportPresent,
+			filename)
+	} else if has {
+		r.opts.Report.ImportAdded = append(r.opts.Report.ImportAdded, filename)
+	}
+}
+
+// reportSignature records the change of fn's signature to newType in the
+// report, if there is one.
+func (r *rewriter) reportSignature(fn *ast.FuncDecl, newType *ast.FuncType) {
+	if r.opts.Report == nil {
+		return
+	}
+	if r.opts.Report.Signatures == nil {
+		r.opts.Report.Signatures = map[string]SignatureChange{}
+	}
+	signature := func(ft *ast.FuncType) string {
+		return fn.Name.Name +
+			strings.TrimPrefix(types.ExprString(ft), "func")
+	}
+	change := SignatureChange{Old: signature(fn.Type), New: signature(newType)}
+	r.opts.Report.Signatures[r.packageName+"."+funcName(fn)] = change
+	r.reportCodemod(fn, change, newType)
+}
@@ -0,0 +1,57 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// stampVersion returns source with its version stamp, if it has one,
+// replaced by a fresh one on its own line after the package clause.
+func stampVersion(source []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", source, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	file := fset.File(f.Pos())
+	offset := file.Offset(lineAfter(file, packageLineEnd(file, f)))
+	rest := source[offset:]
+	if stamp := versionStamp(file, f); stamp != nil {
+		// also drop the blank line that separated the old stamp
+		rest = source[file.Offset(lineAfter(file, stamp.End())):]
+	}
+	var out bytes.Buffer
+	out.Write(source[:offset])
+	out.WriteString("\n" + versionStampPrefix + Version + "\n")
+	out.Write(rest)
+	return out.Bytes(), nil
+}
+
+// versionStamp returns f's version stamp, if it has one where stampVersion
+// writes it: after a blank line below the package clause, and before
+// anything else. A comment that just looks like a stamp elsewhere is not
+// one.
+func versionStamp(file *token.File, f *ast.File) *ast.Comment {
+	end := packageLineEnd(file, f)
+	for _, group := range f.Comments {
+		if group.Pos() <= end {
+			continue
+		}
+		stamp := group.List[0]
+		if file.Line(stamp.Pos()) != file.Line(end)+2 ||
+			!strings.HasPrefix(stamp.Text, versionStampPrefix) {
+			return nil
+		}
+		// a declaration added by the rewrite has no position yet
+		for _, decl := range f.Decls {
+			if decl.Pos().IsValid() && decl.Pos() < stamp.Pos() {
+				return nil
+			}
+		}
+		return stamp
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package ctxrewriter
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+)
+
+// symbols is a package's function and method names, for
+// Options.OnlyPackageCalls and for telling which method calls
+// Options.ExemptMethods covers.
+type symbols struct {
+	// funcs maps the package's top-level functions' names to their types.
+	funcs map[string]*ast.FuncType
+	// funcFields holds the names of struct fields with func types.
+	funcFields map[string]bool
+	// methods maps receiver type names to their methods' names and types.
+	methods map[string]map[string]*ast.FuncType
+	// ifaces holds the names of the interface types among methods.
+	ifaces map[string]bool
+	// decls holds the package's function and method declarations.
+	decls []*ast.FuncDecl
+}
+
+func (s *symbols) add(f *ast.File) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		if st, ok := n.(*ast.StructType); ok {
+			for _, field := range st.Fields.List {
+				if _, ok := field.Type.(*ast.FuncType); ok {
+					for _, name := range field.Names {
+						s.funcFields[name.Name] = true
+					}
+				}
+			}
+		}
+		return true
+	})
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok {
+			s.addInterfaces(gen)
+			continue
+		}
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		s.decls = append(s.decls, fn)
+		if fn.Recv == nil {
+			s.funcs[fn.Name.Name] = fn.Type
+			continue
+		}
+		typ := receiverType(fn)
+		if s.methods[typ] == nil {
+			s.methods[typ] = map[string]*ast.FuncType{}
+		}
+		s.methods[typ][fn.Name.Name] = fn.Type
+	}
+}
+
+// addInterfaces records the methods of the interface types gen declares
+// like those of any other type, since calls through an interface have to
+// agree with the interface's signatures.
+func (s *symbols) addInterfaces(gen *ast.GenDecl) {
+	for _, spec := range gen.Specs {
+		ts, ok := spec.(*ast.TypeSpec)
+		if !ok {
+			continue
+		}
+		iface, ok := ts.Type.(*ast.InterfaceType)
+		if !ok {
+			continue
+		}
+		for _, method := range iface.Methods.List {
+			ft, ok := method.Type.(*ast.FuncType)
+			if !ok || len(method.Names) != 1 {
+				continue
+			}
+			if s.methods[ts.Name.Name] == nil {
+				s.methods[ts.Name.Name] = map[string]*ast.FuncType{}
+			}
+			s.methods[ts.Name.Name][method.Names[0].Name] = ft
+			s.ifaces[ts.Name.Name] = true
+		}
+	}
+}
+
+// hasMethod reports whether any of the package's types has a method name.
+func (s *symbols) hasMethod(name string) bool {
+	for _, methods := range s.methods {
+		if methods[name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConcreteMethod reports whether any of the package's types other than its
+// interfaces has a method name.
+func (s *symbols) hasConcreteMethod(name string) bool {
+	for typ, methods := range s.methods {
+		if !s.ifaces[typ] && methods[name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIfaceMethod reports whether any of the package's interfaces has a
+// method name.
+func (s *symbols) hasIfaceMethod(name string) bool {
+	for typ := range s.ifaces {
+		if s.methods[typ][name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// packageSymbols collects the functions and methods of f, and if dir is set,
+// of the Go files in dir that belong to the same package, except for
+// filename, which is f's. Files that fail to parse are skipped.
+func packageSymbols(f *ast.File, filename, dir string) *symbols {
+	s := &symbols{funcs: map[string]*ast.FuncType{},
+		funcFields: map[string]bool{},
+		methods:    map[string]map[string]*ast.FuncType{},
+		ifaces:     map[string]bool{}}
+	s.add(f)
+	if dir == "" {
+		return s
+	}
+	siblings, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, sibling := range siblings {
+		if filepath.Base(sibling) == filepath.Base(filename) {
+			continue
+		}
+		other, err := parser.ParseFile(token.NewFileSet(), sibling, nil,
+			parser.SkipObjectResolution)
+		if err != nil || other.Name.Name != f.Name.Name {
+			continue
+		}
+		s.add(other)
+	}
+	return s
+}
+
+// packageCall reports whether fun, the function of a call, is one of the
+// package's own functions or methods, for Options.OnlyPackageCalls.
+func (r *rewriter) packageCall(fun ast.Expr) bool {
+	switch v := uninstantiated(fun).(type) {
+	case *ast.FuncLit:
+		return true
+	case *ast.ParenExpr:
+		return r.packageCall(v.X)
+	case *ast.Ident:
+		if v.Obj != nil && v.Obj.Kind == ast.Var {
+			// a local variable, which counts only if it's assigned a
+			// function literal, since the literal gains ctx
+			return funcLitVar(v)
+		}
+		if r.variable(v) {
+			return false
+		}
+		return r.symbols.funcs[v.Name] != nil
+	case *ast.SelectorExpr:
+		x, ok := v.X.(*ast.Ident)
+		if ok && r.imports[x.Name] != "" {
+			return false
+		}
+		if r.variable(v.Sel) {
+			// a field holding a function
+			return false
+		}
+		if ok && x.Name == r.recvName {
+			return r.symbols.methods[r.recvType][v.Sel.Name] != nil
+		}
+		return r.symbols.hasMethod(v.Sel.Name)
+	}
+	return false
+}
+
+// funcLitVar reports whether the variable ident is declared with a function
+// literal as its value.
+func funcLitVar(ident *ast.Ident) bool {
+	_, ok := declaredValue(ident).(*ast.FuncLit)
+	return ok
+}
+
+// declaredValue returns the value the variable ident is declared with, or
+// nil if it's declared without one (e.g. as a parameter) or the declaration
+// isn't known.
+func declaredValue(ident *ast.Ident) ast.Expr {
+	if ident.Obj == nil {
+		return nil
+	}
+	var names []*ast.Ident
+	var values []ast.Expr
+	switch decl := ident.Obj.Decl.(type) {
+	case *ast.ValueSpec:
+		names, values = decl.Names, decl.Values
+	case *ast.AssignStmt:
+		for _, lhs := range decl.Lhs {
+			name, _ := lhs.(*ast.Ident)
+			names = append(names, name)
+		}
+		values = decl.Rhs
+	}
+	if len(names) != len(values) {
+		return nil
+	}
+	for i, name := range names {
+		if name != nil && name.Name == ident.Name {
+			return values[i]
+		}
+	}
+	return nil
+}
+
+// variable reports whether type information shows ident to be a variable
+// (or struct field) rather than a function.
+func (r *rewriter) variable(ident *ast.Ident) bool {
+	if r.types == nil {
+		return false
+	}
+	_, ok := r.types.Uses[ident].(*types.Var)
+	return ok
+}
+
+// receiver returns the name of fn's receiver and its type's name, if fn is a
+// method with a named receiver.
+func receiver(fn *ast.FuncDecl) (name, typ string) {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 ||
+		len(fn.Recv.List[0].Names) == 0 {
+		return "", ""
+	}
+	name = fn.Recv.List[0].Names[0].Name
+	if name == "_" {
+		return "", ""
+	}
+	return name, receiverType(fn)
+}
+
+// fixedArgs returns how many arguments a call to fun, a variadic function or
+// method the package declares, passes before the variadic ones, not counting
+// ctx, so that ctx can go before them in calls that don't spread a slice.
+// Methods count only if all the package's methods of that name agree.
+func (r *rewriter) fixedArgs(fun ast.Expr) (int, bool) {
+	var fts []*ast.FuncType
+	switch v := unparen(fun).(type) {
+	case *ast.Ident:
+		if r.variable(v) || (v.Obj != nil && v.Obj.Kind == ast.Var) {
+			return 0, false
+		}
+		fts = append(fts, r.symbols.funcs[v.Name])
+	case *ast.SelectorExpr:
+		if x, ok := v.X.(*ast.Ident); ok && r.imports[x.Name] != "" {
+			return 0, false
+		}
+		for _, methods := range r.symbols.methods {
+			if ft := methods[v.Sel.Name]; ft != nil {
+				fts = append(fts, ft)
+			}
+		}
+	}
+	fixed := -1
+	for _, ft := range fts {
+		if ft == nil || !variadic(ft.Params) {
+			return 0, false
+		}
+		n := 0
+		for _, field := range ft.Params.List[:len(ft.Params.List)-1] {
+			if r.contextType(field.Type) {
+				continue
+			}
+			if len(field.Names) == 0 {
+				n++
+			}
+			n += len(field.Names)
+		}
+		if fixed >= 0 && n != fixed {
+			return 0, false
+		}
+		fixed = n
+	}
+	return fixed, fixed >= 0
+}
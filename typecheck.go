@@ -0,0 +1,81 @@
+package ctxrewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"strconv"
+	"sync"
+)
+
+// sourceImporter imports packages from source for TypeCheck and
+// CheckContextType. Importing from source is slow, so one importer, with a
+// file set of its own, is created on first use and shared by every file
+// after, reusing the packages it has already imported. importMu guards it,
+// since importers aren't safe for concurrent use.
+var (
+	importMu       sync.Mutex
+	sourceImporter types.Importer
+)
+
+// sharedImporter imports through sourceImporter.
+type sharedImporter struct{}
+
+func (sharedImporter) Import(path string) (*types.Package, error) {
+	importMu.Lock()
+	defer importMu.Unlock()
+	if sourceImporter == nil {
+		sourceImporter = importer.ForCompiler(token.NewFileSet(), "source",
+			nil)
+	}
+	return sourceImporter.Import(path)
+}
+
+// typeInfo type-checks f on its own, recording the types of its expressions.
+// The package's other files aren't available, so errors are expected and
+// ignored; whatever could be resolved is still recorded.
+func typeInfo(fset *token.FileSet, f *ast.File) *types.Info {
+	info := &types.Info{Types: map[ast.Expr]types.TypeAndValue{},
+		Uses: map[*ast.Ident]types.Object{}}
+	config := types.Config{
+		Importer: sharedImporter{},
+		Error:    func(error) {},
+	}
+	config.Check(f.Name.Name, fset, []*ast.File{f}, info)
+	return info
+}
+
+// isConversion reports whether fun, the function of a call in the original
+// file, is known from type information to denote a type, making the call a
+// conversion like MyType(v).
+func (r *rewriter) isConversion(fun ast.Expr) bool {
+	if r.types == nil {
+		return false
+	}
+	tv, ok := r.types.Types[fun]
+	return ok && tv.IsType()
+}
+
+// CheckContextType verifies that the context package the rewrite under opts
+// would import can be loaded and exports the Context type that new
+// parameters refer to, so that a bad configuration fails early instead of
+// producing code that doesn't compile. The package is loaded from source
+// with go/importer, as for TypeCheck, rather than with go/packages, which
+// would make golang.org/x/tools a dependency.
+func CheckContextType(opts Options) error {
+	path, err := strconv.Unquote(
+		newRewriter(token.NewFileSet(), opts).importPath())
+	if err != nil {
+		return err
+	}
+	pkg, err := sharedImporter{}.Import(path)
+	if err != nil {
+		return fmt.Errorf("can't load context package %q: %v", path, err)
+	}
+	if _, ok := pkg.Scope().Lookup("Context").(*types.TypeName); !ok {
+		return fmt.Errorf("package %q doesn't export a Context type", path)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package ctxrewriter
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+)
+
+// wrapLines breaks each line of source longer than width columns, counting a
+// tab as tabwidth, after a comma between two arguments of a call or two
+// parameters of a function, including parameters sharing a type. The break
+// goes at the last such comma that keeps the line within width, or failing
+// that, the first. The rest of the line gets one more tab of indentation
+// than the line it came from, unless that line already continues the same
+// list. Lines that can't be broken this way are left long.
+func wrapLines(source []byte, width, tabwidth int) ([]byte, error) {
+	for {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "", source, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		file := fset.File(f.Pos())
+		breaks := lineBreaks(file, f, source)
+
+		broke := false
+		for line := 1; line <= file.LineCount() && !broke; line++ {
+			start := file.Offset(file.LineStart(line))
+			end := len(source)
+			if line < file.LineCount() {
+				end = file.Offset(file.LineStart(line+1)) - 1
+			}
+			if columns(source[start:end], tabwidth) <= width {
+				continue
+			}
+			var at *lineBreak
+			for i, b := range breaks[line] {
+				if at == nil ||
+					columns(source[start:b.offset], tabwidth) <= width {
+					at = &breaks[line][i]
+				}
+			}
+			if at == nil {
+				continue
+			}
+			indent := leadingTabs(source[start:end])
+			if !at.continued {
+				indent = append(indent, '\t')
+			}
+			var out bytes.Buffer
+			out.Write(source[:at.offset])
+			out.WriteByte('\n')
+			out.Write(indent)
+			out.Write(bytes.TrimLeft(source[at.offset:], " "))
+			source = out.Bytes()
+			broke = true
+		}
+		if !broke {
+			return source, nil
+		}
+	}
+}
+
+// lineBreak is an offset just after a comma where a line may be broken, and
+// whether the line the comma is on already continues its list.
+type lineBreak struct {
+	offset    int
+	continued bool
+}
+
+// lineBreaks finds the commas between the arguments of f's calls and the
+// parameters (or parameter names) of its functions that are followed by
+// more of the list on the same line, by line and in order.
+func lineBreaks(file *token.File, f *ast.File,
+	source []byte) map[int][]lineBreak {
+	breaks := map[int][]lineBreak{}
+	list := func(opening token.Pos, n int, at func(int) ast.Node) {
+		for i := 0; i+1 < n; i++ {
+			offset := file.Offset(at(i).End())
+			if offset >= len(source) || source[offset] != ',' ||
+				file.Line(at(i).End()) != file.Line(at(i+1).Pos()) {
+				continue
+			}
+			line := file.Line(at(i).End())
+			breaks[line] = append(breaks[line], lineBreak{
+				offset:    offset + 1,
+				continued: file.Line(opening) != line})
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.CallExpr:
+			list(v.Lparen, len(v.Args),
+				func(i int) ast.Node { return v.Args[i] })
+		case *ast.FuncType:
+			if v.Params != nil {
+				list(v.Params.Opening, len(v.Params.List),
+					func(i int) ast.Node { return v.Params.List[i] })
+				for _, field := range v.Params.List {
+					list(v.Params.Opening, len(field.Names),
+						func(i int) ast.Node { return field.Names[i] })
+				}
+			}
+		}
+		return true
+	})
+	for _, line := range breaks {
+		sort.Slice(line, func(i, j int) bool {
+			return line[i].offset < line[j].offset
+		})
+	}
+	return breaks
+}
+
+// columns returns how many columns line takes up, with tabs at tabwidth.
+func columns(line []byte, tabwidth int) int {
+	n := 0
+	for _, r := range string(line) {
+		if r == '\t' {
+			n += tabwidth - n%tabwidth
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func leadingTabs(line []byte) []byte {
+	n := 0
+	for n < len(line) && line[n] == '\t' {
+		n++
+	}
+	return append([]byte(nil), line[:n]...)
+}